@@ -5,10 +5,14 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -19,7 +23,6 @@ import (
 
 	"github.com/Tkanos/gonfig" // config management support
 	"github.com/lib/pq"        // golang postgres db driver
-	"gopkg.in/gomail.v2"       // outbound email support
 )
 
 // globals5
@@ -46,6 +49,64 @@ type configuration struct {
 	TitleNotReady     string
 	SubjectPrefix     string
 	ManagersEmail     string
+
+	MaxDeliveryAttempts int // attempts per notification before it is abandoned
+	RetryBackoffSeconds int // delay before the first retry, doubled for each one after
+
+	Jobs       map[string]string // job name -> cron schedule, e.g. "dispatch": "@every 60s"
+	AdminToken string            // required by admin-only endpoints such as /RunJob; without one they are refused
+
+	Channels        []channelConfig // notification channels, see notifier.go
+	Routes          []routeConfig   // which channels each notification goes out on
+	DefaultChannels []string        // used when no route matches, "smtp" if empty
+
+	TemplatePath string // folder holding the email templates, one <kind>.html and <kind>.txt each
+	BaseURL      string // how recipients reach DAMInform, for links in emails
+
+	Directory     directoryConfig // where users missing from the recipient table are looked up
+	FallbackEmail string          // gets the notifications of users no directory knows
+
+	SMTPHost      string
+	SMTPPort      int
+	SMTPSecurity  string // none, starttls or tls
+	SMTPUser      string // no authentication when empty
+	SMTPPassword  string // better kept in SecretsFile or DAMINFORM_SMTPPASSWORD than here
+	SenderName    string
+	SenderAddress string
+	SecretsFile   string // json file of secrets that override config.json, kept out of the repo
+
+	DedupWindowMinutes map[string]int // notification kind (or "*") -> minutes a repeat is suppressed for
+
+	SeverityByStatus       map[string]string // ticket status title -> severity; TitleEmergency and TitleUrgent default to high
+	TicketStatusQuery      string            // finds a ticket's status title, $1 being the jira key; no severity without it
+	HighPrioritySubjectTag string            // put in front of the subject of high-priority notifications
+	HighPriorityChannels   []string          // channels high-priority notifications also go out on
+
+	AckSecret                  string // signs acknowledge links; better kept in SecretsFile or DAMINFORM_ACKSECRET
+	EscalateLeadAfterHours     *int   // remind the lead of a notification unacknowledged this long, 0 never, unset 24
+	EscalateManagersAfterHours *int   // then tell the managers after this long, 0 never, unset 72
+
+	AttachWhereUsed bool // attach the where used report to notifications about an asset, and summarise it in the body
+
+	WalkWorkers int // folders of the changeset repository listed at once, see walker.go
+
+	HeartbeatTimeoutSeconds int // how long DAMLogger has to record a heartbeat canary, see heartbeat.go
+
+	AssetTypes []assetType // the kinds of file the changeset repository tracks, see assettypes.go; templates when empty
+
+	CheckTemplateContent *bool // read templates in every integrity check, not only deep ones, see templatecheck.go; unset true
+
+	Environments []environmentConfig // DEV, TEST, PROD... served by this one DAMInform, see environments.go
+}
+
+// the settings that may come from the secrets file or environment instead of config.json
+type secrets struct {
+	DBpw             string
+	SMTPPassword     string
+	LDAPBindPassword string
+	AckSecret        string
+
+	EnvironmentDBpw map[string]string // environment name -> DBpw, also DAMINFORM_DBPW_<NAME>
 }
 
 // called on run, sets up http listener on port defined in config file.
@@ -57,33 +118,222 @@ func main() {
 			println("DAMInform v" + gBuild)
 			return
 		}
+		if strings.ToLower(aSwitch) == "-fakesmtp" {
+			port := "2525"
+			folder := "downloads/fakesmtp"
+			if len(os.Args) > 2 {
+				port = os.Args[2]
+			}
+			if len(os.Args) > 3 {
+				folder = os.Args[3]
+			}
+			if err := runFakeSMTP(port, folder); err != nil {
+				fmt.Println("ERROR " + err.Error())
+			}
+			return
+		}
+		// DAMInform -env <name> ... : the worker for one of config.Environments
+		if strings.ToLower(aSwitch) == "-env" && len(os.Args) > 2 {
+			environmentName = os.Args[2]
+			os.Args = append(os.Args[:1], os.Args[3:]...)
+		}
 	}
 
 	err := gonfig.GetConf("config.json", &sessionConfig)
 	if err != nil {
 		panic(err) //TODO:
 	}
+	err = loadSecrets()
+	if err != nil {
+		panic(err)
+	}
+
+	preview := len(os.Args) > 1 && strings.ToLower(os.Args[1]) == "-preview"
+	if environmentName == "" && len(sessionConfig.Environments) > 0 {
+		if !preview {
+			setConfigDefaults()
+			runEnvironments()
+			return
+		}
+		environmentName = sessionConfig.Environments[0].Name
+	}
+	if environmentName != "" {
+		if err = useEnvironment(environmentName); err != nil {
+			panic(err)
+		}
+	}
+	setConfigDefaults()
 
 	http.HandleFunc("/", handler)
 	initDb()
 	defer db.Close()
 
+	initAck()
+	if sessionConfig.AdminToken == "" {
+		logMessage("Admin: no AdminToken configured, admin endpoints such as /RunJob and /Repair are refused", "", "INFO")
+	}
+	initDirectory()
+	initSeverity()
+	initNotifiers()
+	initTemplates()
+
+	// DAMInform -preview [json] : print what the next dispatch would send, then exit
+	if preview {
+		report := ""
+		if len(os.Args) > 2 && strings.ToLower(os.Args[2]) == "json" {
+			getPreviewJSON(&report)
+		} else {
+			getPreview(&report)
+		}
+		fmt.Println(report)
+		return
+	}
+
+	checkSMTP()
+	registerJobs()
+	startScheduler()
+	defer scheduler.Stop()
+	startListener()
+
+	listen := ":" + sessionConfig.ListenPort
+	if environmentName != "" {
+		// only the main process talks to an environment's worker, see environments.go
+		listen = "127.0.0.1:" + sessionConfig.ListenPort
+		log.Println("Environment " + environmentName + ": " + sessionConfig.ChangesetPath)
+	}
+
 	log.Println("Listening... (" + sessionConfig.ListenPort + ")")
 
-	err = http.ListenAndServe(":"+sessionConfig.ListenPort, nil)
+	err = http.ListenAndServe(listen, nil)
 	if err != nil {
 		fmt.Println("ERROR " + err.Error())
 	}
 }
 
+// reads secrets from config.SecretsFile, then from DAMINFORM_<NAME> environment variables,
+// each overriding what config.json holds.
+func loadSecrets() error {
+
+	found := secrets{}
+
+	if sessionConfig.SecretsFile != "" {
+		content, err := os.ReadFile(sessionConfig.SecretsFile)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(content, &found); err != nil {
+			return fmt.Errorf("secrets file %s: %s", sessionConfig.SecretsFile, err.Error())
+		}
+	}
+
+	if value, ok := os.LookupEnv("DAMINFORM_DBPW"); ok {
+		found.DBpw = value
+	}
+	if value, ok := os.LookupEnv("DAMINFORM_SMTPPASSWORD"); ok {
+		found.SMTPPassword = value
+	}
+	if value, ok := os.LookupEnv("DAMINFORM_LDAPBINDPASSWORD"); ok {
+		found.LDAPBindPassword = value
+	}
+	if value, ok := os.LookupEnv("DAMINFORM_ACKSECRET"); ok {
+		found.AckSecret = value
+	}
+
+	if found.DBpw != "" {
+		sessionConfig.DBpw = found.DBpw
+	}
+	if found.SMTPPassword != "" {
+		sessionConfig.SMTPPassword = found.SMTPPassword
+	}
+	if found.LDAPBindPassword != "" {
+		sessionConfig.Directory.BindPassword = found.LDAPBindPassword
+	}
+	if found.AckSecret != "" {
+		sessionConfig.AckSecret = found.AckSecret
+	}
+
+	for i := range sessionConfig.Environments {
+		e := &sessionConfig.Environments[i]
+		if value, ok := found.EnvironmentDBpw[e.Name]; ok {
+			e.DBpw = value
+		}
+		if value, ok := os.LookupEnv("DAMINFORM_DBPW_" + strings.ToUpper(e.Name)); ok {
+			e.DBpw = value
+		}
+	}
+
+	return nil
+}
+
+// fills in settings that older config files don't carry.
+func setConfigDefaults() {
+
+	if sessionConfig.MaxDeliveryAttempts <= 0 {
+		sessionConfig.MaxDeliveryAttempts = 5
+	}
+	if sessionConfig.RetryBackoffSeconds <= 0 {
+		sessionConfig.RetryBackoffSeconds = 60
+	}
+	if sessionConfig.SMTPHost == "" {
+		sessionConfig.SMTPHost = "mail"
+	}
+	if sessionConfig.SMTPPort <= 0 {
+		sessionConfig.SMTPPort = 25
+	}
+	if sessionConfig.SMTPSecurity == "" {
+		sessionConfig.SMTPSecurity = cSMTPNONE
+		if sessionConfig.SMTPPort == 465 {
+			sessionConfig.SMTPSecurity = cSMTPTLS
+		}
+	}
+	if sessionConfig.SenderAddress == "" {
+		sessionConfig.SenderAddress = "noreply@ahs.ca"
+	}
+	if sessionConfig.SenderName == "" {
+		sessionConfig.SenderName = "DAM"
+	}
+	if sessionConfig.TemplatePath == "" {
+		sessionConfig.TemplatePath = "templates/email"
+	}
+	if sessionConfig.BaseURL == "" {
+		hostname, _ := os.Hostname()
+		sessionConfig.BaseURL = "http://" + hostname + ":" + sessionConfig.ListenPort
+	}
+	if sessionConfig.EscalateLeadAfterHours == nil {
+		hours := 24
+		sessionConfig.EscalateLeadAfterHours = &hours
+	}
+	if sessionConfig.EscalateManagersAfterHours == nil {
+		hours := 72
+		sessionConfig.EscalateManagersAfterHours = &hours
+	}
+	if sessionConfig.CheckTemplateContent == nil {
+		check := true
+		sessionConfig.CheckTemplateContent = &check
+	}
+	if sessionConfig.WalkWorkers <= 0 {
+		sessionConfig.WalkWorkers = 8
+	}
+	if sessionConfig.HeartbeatTimeoutSeconds <= 0 {
+		sessionConfig.HeartbeatTimeoutSeconds = 120
+	}
+	// the heartbeat runs every 20 minutes and copies the managers: a daily reminder is plenty while it keeps failing
+	if _, ok := sessionConfig.DedupWindowMinutes[cKINDHEARTBEAT]; !ok {
+		if sessionConfig.DedupWindowMinutes == nil {
+			sessionConfig.DedupWindowMinutes = make(map[string]int)
+		}
+		sessionConfig.DedupWindowMinutes[cKINDHEARTBEAT] = 1440
+	}
+	setSeverityDefaults()
+	setAssetTypeDefaults()
+}
+
 // initializes the db [postgres] connection with params held in the config file.
 func initDb() {
 
 	var err error
 
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", sessionConfig.DBhost, sessionConfig.DBPort, sessionConfig.DBusr, sessionConfig.DBpw, sessionConfig.DBName)
-
-	db, err = sql.Open("postgres", psqlInfo)
+	db, err = sql.Open("postgres", dbConnInfo())
 	if err != nil {
 		panic(err)
 	}
@@ -91,9 +341,17 @@ func initDb() {
 	if err != nil {
 		panic(err)
 	}
+	err = ensureSchema()
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println("DAMInform v" + gBuild + " - Successfully connected!")
 }
 
+func dbConnInfo() string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", sessionConfig.DBhost, sessionConfig.DBPort, sessionConfig.DBusr, sessionConfig.DBpw, sessionConfig.DBName)
+}
+
 // standard http handler
 // see also getDynamic()
 func handler(w http.ResponseWriter, r *http.Request) {
@@ -124,42 +382,182 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		if strings.Contains(r.URL.Path, "Preview") {
+
+			if strings.HasSuffix(strings.ToLower(r.URL.Path), ",json") {
+				if getPreviewJSON(&report) {
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprint(w, report)
+				}
+			} else if getPreview(&report) {
+				fmt.Fprint(w, report)
+			}
+		}
+
 		if strings.Contains(r.URL.Path, "Dispatch") {
 
-			if doDispatch() {
+			err := runJob("dispatch", "http")
+			if err == errJobRunning {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, "dispatch already running")
+			} else if err == nil {
 				fmt.Fprintf(w, report)
 			}
 		}
 
-		if strings.Contains(r.URL.Path, "FixTicket") {
+		if strings.Contains(r.URL.Path, "Delivery") {
+			handleDelivery(w, r)
+		}
 
-			params := strings.Split(r.RequestURI, ",")
+		if strings.Contains(r.URL.Path, "Subscriptions") {
+			handleSubscriptions(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "Ack") {
+			handleAck(w, r)
+		}
 
-			if len(params) < 1 {
+		if strings.Contains(r.URL.Path, "Jobs") {
+			// the run buttons post back with the admin token the page was opened with
+			query := ""
+			if token := r.URL.Query().Get("token"); token != "" {
+				query = "?token=" + url.QueryEscape(token)
+			}
+			if getJobs(&report, query) {
+				fmt.Fprint(w, report)
+			}
+		}
+
+		if strings.Contains(r.URL.Path, "RunJob") {
+			handleRunJob(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "Heartbeat") {
+			if getHeartbeat(&report) {
+				fmt.Fprint(w, report)
+			}
+		}
+
+		if strings.Contains(r.URL.Path, "Walks") {
+			if getWalks(&report) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, report)
+			}
+		}
+
+		if strings.Contains(r.URL.Path, "CancelJob") {
+
+			if !isAdmin(r) {
+				w.WriteHeader(http.StatusForbidden)
 				return
 			}
 
-			ticketToFix := strings.Trim(params[1], "/") // operation type
+			params := strings.Split(r.URL.Path, ",")
+			if len(params) < 2 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 
-			if fixTicket(ticketToFix) {
-				w.WriteHeader(http.StatusOK)
+			jobname := strings.Trim(params[1], "/")
+			switch cancelJob(jobname) {
+			case errJobUnknown:
+				w.WriteHeader(http.StatusNotFound)
+			case errJobNotRunning:
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, "%s is not running here", jobname)
+			default:
+				logMessage("Job "+jobname+" cancelled by hand from "+clientAddress(r), "", "INFO")
+				fmt.Fprintf(w, "%s cancelled", jobname)
+			}
+		}
 
-			} else {
-				w.WriteHeader(http.StatusTeapot)
+		if strings.Contains(r.URL.Path, "FixTicket") {
+
+			params := strings.Split(r.URL.Path, ",")
+			if len(params) < 2 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			// nothing is applied without a confirmed plan: show the dry run, keeping any admin token
+			target := environmentPath("/Repair," + url.PathEscape(strings.Trim(params[1], "/")))
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusSeeOther)
+			return
+		}
+
+		if strings.Contains(r.URL.Path, "Repair") {
+			handleRepair(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "IntegrityHistory") {
+			if getIntegrityHistory(&report) {
+				fmt.Fprint(w, report)
+			}
+		}
+
+		if strings.Contains(r.URL.Path, "GraphCheck") {
+
+			result := graphResult{}
+			ok := doGraphCheck(r.Context(), &result)
+			if r.Context().Err() != nil {
+				return
+			}
 
+			if strings.HasSuffix(strings.ToLower(r.URL.Path), ",html") {
+				if getGraphCheckReport(&report, result, ok) {
+					fmt.Fprint(w, report)
+				}
+			} else if getGraphCheckJSON(&report, result, ok) {
+				w.Header().Set("Content-Type", "application/json")
+				if !ok {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+				fmt.Fprint(w, report)
 			}
 		}
 
 		if strings.Contains(r.URL.Path, "IntegrityCheck") {
 
-			assetProblem := make(map[string]string)
+			result := integrityResult{}
+			lowerpath := strings.ToLower(r.URL.Path)
+			result.Deep = strings.Contains(lowerpath, ",deep")
+			if strings.Contains(lowerpath, ",rebaseline") {
+				if !isAdmin(r) {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				result.Deep = true
+				result.Rebaseline = true
+			}
+			// under the same lock as the integritycheck jobs, so that it never overlaps one
+			ok, err := runIntegrityCheck(r.Context(), &result)
+			if err == errJobRunning {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, "integrity check already running")
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if r.Context().Err() != nil {
+				// the client has gone, there is no one to reply to
+				return
+			}
 
-			if doIntegrityCheck(assetProblem) {
-				if len(assetProblem) > 0 {
-					w.WriteHeader(http.StatusTeapot)
-				} else {
-					w.WriteHeader(http.StatusOK)
+			if strings.HasSuffix(strings.ToLower(r.URL.Path), ",html") {
+				if getIntegrityReport(&report, result, ok) {
+					fmt.Fprint(w, report)
 				}
+			} else if getIntegrityJSON(&report, result, ok) {
+				w.Header().Set("Content-Type", "application/json")
+				if !ok {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+				fmt.Fprint(w, report)
 			}
 		}
 /* 
@@ -183,172 +581,186 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			}
 		} */
 
+	case "POST", "DELETE":
+		if strings.Contains(r.URL.Path, "Subscriptions") {
+			handleSubscriptions(w, r)
+		}
+		if strings.Contains(r.URL.Path, "Ack") {
+			handleAck(w, r)
+		}
+		if strings.Contains(r.URL.Path, "Repair") {
+			handleRepair(w, r)
+		}
+		if strings.Contains(r.URL.Path, "Delivery") {
+			handleDelivery(w, r)
+		}
+		if strings.Contains(r.URL.Path, "RunJob") {
+			handleRunJob(w, r)
+		}
 	}
 
 }
 
-func testDirectoryMonitoring(path string) bool {
-
-	// create a test file in each folder then query activity table for corresponding records
-
-	return true
-}
+// admin endpoints need the configured AdminToken, as a "token" query parameter or X-DAMInform-Token header.
+// with no AdminToken configured they are closed: nobody can run jobs, rebaseline or apply repairs by hand.
+func isAdmin(r *http.Request) bool {
 
-func fixTicket(ticket string) bool {
-
-	logMessage("INTEGRITY: fixTicket() called", ticket, "INFO")
-
-	subDirToSkip := "downloads"
-	basePath := sessionConfig.ChangesetPath
-	damassetmap := make(map[string]string)
-
-	query := `SELECT folder, filename, fullfilepath
-			FROM public.damasset`
-
-	rows, err := db.Query(query)
-	if err != nil {
-		log.Println(err.Error())
+	if sessionConfig.AdminToken == "" {
 		return false
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		folder := ""
-		filename := ""
-		fullfilepath := ""
-
-		err = rows.Scan(
-			&folder,
-			&filename,
-			&fullfilepath,
-		)
 
-		damassetmap[folder+"~"+filename] = fullfilepath
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = r.Header.Get("X-DAMInform-Token")
 	}
 
-	err = filepath.Walk(basePath+"/"+ticket, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			fmt.Printf("prevent panic by handling failure accessing a path %q: %v\n", path, err)
-			return err
-		}
-		if info.IsDir() && info.Name() == subDirToSkip {
-			//			fmt.Printf("skipping a dir without errors: %+v \n", info.Name())
-			return filepath.SkipDir
-		}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(sessionConfig.AdminToken)) == 1
+}
 
-		if strings.HasSuffix(path, ".oet") {
-			relpath, err := filepath.Rel(basePath, path)
-			if err != nil {
-				return err
-			}
+func testDirectoryMonitoring(path string) bool {
 
-			results := strings.Split(relpath, "/")
-			if len(results) > 0 {
-				ticket := results[0]
-				asset := filepath.Base(relpath)
-				key := ticket + "~" + asset
+	// create a test file in the folder then query activity table for the corresponding record
 
-				// either the file is in damasset or it isn't
-				if _, ok := damassetmap[key]; ok {
-					// asset exists in damassets and in filesystem
-					// so asset can be removed from map.
-					delete(damassetmap, key)
-				} else {
-					logMessage("INTEGRITY: Attempting to fix - Missing in damasset: "+asset, ticket, "ERROR")
+	results := checkHeartbeat(context.Background(), []string{path})
 
-					sqlStatement := `INSERT INTO public.activity_local
-					(filename, operation, directory, "time", optime)
-					VALUES($1, $2, $3, 0, $4);`
+	return len(results) == 1 && results[0].ok()
+}
 
-					_, err = db.Exec(sqlStatement,
-						asset,
-						"MODIFY",
-						filepath.Dir(path),
-						time.Now(),
-					)
+func doIntegrityCheck(ctx context.Context, result *integrityResult) bool {
 
-					if err, ok := err.(*pq.Error); ok {
+	// for each ticket
 
-						logMessage("pq error:"+err.Code.Name()+" - "+err.Message, "", "ERROR")
-					}
+	basePath := sessionConfig.ChangesetPath
 
-				}
+	result.Environment = basePath
+	result.Started = time.Now()
+	result.Walk.AssetsByType = make(map[string]int)
 
-			}
-		}
+	damassetmap := make(map[string]damassetRow)
 
-		return nil
-	})
-	if err != nil {
-		fmt.Printf("error walking the path %q: %v\n", basePath, err)
-		return false
+	var fingerprints map[string]assetFingerprint
+	if result.Deep {
+		var ok bool
+		if fingerprints, ok = getAssetFingerprints(); !ok {
+			result.finish()
+			return false
+		}
 	}
 
-	return true
-}
-
-func doIntegrityCheck(AssetProblem map[string]string) bool {
-
-	// for each ticket
-
-	subDirToSkip := "downloads"
-	basePath := sessionConfig.ChangesetPath
-
-	damassetmap := make(map[string]string)
+	// templates are cheap to read next to the walk itself, so every check can catch a corrupted or half synced one
+	var templates templateIndex
+	result.TemplatesChecked = result.Deep || *sessionConfig.CheckTemplateContent
+	if result.TemplatesChecked {
+		var ok bool
+		if templates, ok = getTemplateIndex(); !ok {
+			result.finish()
+			return false
+		}
+	}
 
-	query := `SELECT folder, filename, fullfilepath
+	query := `SELECT folder, filename, fullfilepath, coalesce(resourcemainid, ''), coalesce(modified, false), coalesce(islatest, false)
 			FROM public.damasset`
 
 	rows, err := db.Query(query)
 	if err != nil {
 		log.Println(err.Error())
+		result.finish()
 		return false
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		folder := ""
-		filename := ""
-		fullfilepath := ""
+		row := damassetRow{}
 
 		err = rows.Scan(
-			&folder,
-			&filename,
-			&fullfilepath,
+			&row.Folder,
+			&row.Filename,
+			&row.FullFilePath,
+			&row.ResourceMainID,
+			&row.Modified,
+			&row.IsLatest,
 		)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
 
-		damassetmap[folder+"~"+filename] = fullfilepath
+		damassetmap[row.Folder+"~"+row.Filename] = row
 	}
+	result.Totals.DamassetRows = len(damassetmap)
 
-	err = filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
+	err = walkChangesets(ctx, "integritycheck", basePath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
+			// note it and carry on with the rest of the tree, unless the root itself is unreadable
 			fmt.Printf("prevent panic by handling failure accessing a path %q: %v\n", path, err)
-			return err
+			if path == basePath {
+				return err
+			}
+			result.Walk.Errors = append(result.Walk.Errors, err.Error())
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		if info.IsDir() && info.Name() == subDirToSkip {
-			return filepath.SkipDir
+		if info.IsDir() {
+			if path != basePath && ignoredFolder(info.Name()) {
+				return filepath.SkipDir
+			}
+			result.Walk.Folders++
+			return nil
 		}
+		result.Walk.Files++
 
-		if strings.HasSuffix(path, ".oet") {
-			relpath, err := filepath.Rel(basePath, path)
-			if err != nil {
-				return err
-			}
+		relpath, err := filepath.Rel(basePath, path)
+		if err != nil {
+			return err
+		}
+
+		if t, ok := assetTypeOf(relpath); ok {
 
 			results := strings.Split(relpath, "/")
 			if len(results) > 0 {
 				ticket := results[0]
 				asset := filepath.Base(relpath)
-				key := ticket + "~" + asset
+				result.Walk.Assets++
+				result.Walk.AssetsByType[t.Name]++
+
+				filename, tracked := t.damassetFilename(asset)
+				key := ticket + "~" + filename
+				row, found := damassetmap[key]
+				found = found && tracked
+
+				// the file is read once: a template for what it says it is, and on a deep check for its fingerprint
+				var current assetFingerprint
+				var contenterr error
+				if result.TemplatesChecked && t.Format == cFORMATOET {
+					var damasset *damassetRow
+					if found {
+						damasset = &row
+					}
+					current, contenterr = checkTemplateContent(result, t, ticket, asset, path, info, damasset, templates)
+				} else if result.Deep && found {
+					current, contenterr = fingerprintFile(path, info)
+				}
+				if contenterr != nil {
+					result.Walk.Errors = append(result.Walk.Errors, contenterr.Error())
+				}
+
+				if !tracked {
+					return nil
+				}
 
 				// either the file is in damasset or it isn't
-				if _, ok := damassetmap[key]; ok {
+				if found {
 					// asset exists in damassets and in filesystem
 					// so asset can be removed from map.
+					if result.Deep && contenterr == nil {
+						checkAssetContent(result, row, path, current, fingerprints)
+					}
 					delete(damassetmap, key)
 				} else {
-					AssetProblem[key] = "missing in damasset"
-					fmt.Printf(sessionConfig.SubjectPrefix+"ERROR - INTEGRITY %q: Missing in damasset - ticket: %q template :%q \n", sessionConfig.ChangesetPath, ticket, asset)
+					result.addProblem(integrityProblem{Ticket: ticket, Asset: asset, Type: t.Name, Kind: cPROBLEMMISSINGDAMASSET, Path: path})
+					fmt.Printf(sessionConfig.SubjectPrefix+"ERROR - INTEGRITY %q: Missing in damasset - ticket: %q %s :%q \n", sessionConfig.ChangesetPath, ticket, t.Name, asset)
 					logMessage("INTEGRITY: "+basePath+" -  Missing in damasset: "+asset, ticket, "ERROR")
 				}
 
@@ -359,39 +771,50 @@ func doIntegrityCheck(AssetProblem map[string]string) bool {
 	})
 	if err != nil {
 		fmt.Printf("error walking the path %q: %v\n", basePath, err)
+		result.Walk.Errors = append(result.Walk.Errors, err.Error())
+		recordIntegrityRun(result, false)
 		return false
 	}
 
-	for a := range damassetmap {
-		AssetProblem[a] = "in damasset, not in filesystem"
+	for a, row := range damassetmap {
+		damasset := row
+		result.addProblem(integrityProblem{Ticket: row.Folder, Asset: row.Filename, Kind: cPROBLEMMISSINGFILESYSTEM, Path: row.FullFilePath, DamAsset: &damasset})
 		fmt.Printf(sessionConfig.SubjectPrefix+"ERROR - INTEGRITY %q: Missing in filesystem (in damasset) - %q \n", sessionConfig.ChangesetPath, a)
 		logMessage("INTEGRITY: Missing in filesystem (in damasset) : "+sessionConfig.ChangesetPath, a, "ERROR")
 
 	}
-
-	if len(AssetProblem) > 0 {
-		// need to queue a notification now....
-		sqlStatement := `
-		INSERT INTO public.notificationqueue
-		(message, jirakey, asset, created, notifymgr, lead)
-		VALUES( $1, $2, $3, $4, $5, $6);`
-
-		notificationmessage := "Problems with AssetTracking on " + sessionConfig.ChangesetPath + ". DAMLogger should be restarted for this environment."
-
-		_, err = db.Exec(sqlStatement,
-			notificationmessage,
-			"",
-			"",
-			time.Now(),
-			true,
-			"jon.beeby",
-		)
-
-		if err, ok := err.(*pq.Error); ok {
-			logMessage("pq error:"+err.Code.Name()+" - "+err.Message, "", "ERROR")
+	result.sortProblems()
+	recorded := recordIntegrityRun(result, true)
+
+	// template problems are the files themselves, not tracking: they go out as a notification of their own
+	tracking, templateproblems := splitTemplateProblems(result.Problems)
+	newtracking, newtemplates := splitTemplateProblems(result.New)
+
+	// a shallow run can't see content problems go, so resolve only once nothing of that kind is open
+	if open, ok := getOpenIntegrityKinds(result.Environment); recorded && ok {
+		opentracking, opentemplates := 0, 0
+		for kind, count := range open {
+			if isTemplateProblem(kind) {
+				opentemplates += count
+			} else {
+				opentracking += count
+			}
+		}
+		if opentracking == 0 {
+			resolveNotifications(cKINDINTEGRITY, "", "", "Asset tracking on "+sessionConfig.ChangesetPath+" is working again.")
+		}
+		if opentemplates == 0 {
+			resolveNotifications(cKINDTEMPLATECONTENT, "", "", "The template files on "+sessionConfig.ChangesetPath+" are all well formed and agree with DAM again.")
 		}
 	}
 
+	if len(tracking) > 0 {
+		queueIntegrityNotification(cKINDINTEGRITY, "Problems with AssetTracking on "+sessionConfig.ChangesetPath+":", tracking, newtracking)
+	}
+	if len(templateproblems) > 0 {
+		queueIntegrityNotification(cKINDTEMPLATECONTENT, "Problems with template files on "+sessionConfig.ChangesetPath+":", templateproblems, newtemplates)
+	}
+
 	return true
 }
 /* 
@@ -593,36 +1016,28 @@ func addSection(name string, columnnumber int) string {
 	return tablebody
 }
 
-func getWUR(report *string, Path string) bool {
-
-	fmt.Println("DAMInform : getWUR() " + Path)
+// the assets that use a template, sorted into the sections of the where used report.
+func getWhereUsed(assetID string) (whereUsed, bool) {
 
-	parts := strings.Split(Path, ",")
+	wu := whereUsed{AssetID: assetID}
 
-	assetID := parts[1]
-
-	fmt.Println("DAMInform : getWUR() " + assetID)
-
-	
 	rows, err := db.Query("select resourcemaindisplayname from ckmresource c where resourcemainid = $1", assetID)
 	if err != nil {
 		log.Println(err.Error())
-		return false
+		return wu, false
 	}
 	defer rows.Close()
 
-	assetdisplayname := ""
-
 	for rows.Next() {
 
 		err = rows.Scan(
-			&assetdisplayname,
+			&wu.AssetName,
 		)
 
 		if err != nil {
 			log.Println(err.Error())
-			return false
-		}		
+			return wu, false
+		}
 	}
 
 	query :=`select distinct ms_p.filename, ms_p.templateid, ms_c.filename as childname, rels.isReleased, ms_p.cid
@@ -631,24 +1046,15 @@ func getWUR(report *string, Path string) bool {
 		and childid = ms_c.templateid  
 		and childid = $1 order by 1 asc`
 
-	tabledef := ""
-	tableheader := ""
-	tablebody := ""
-	columnnumber := 5
-
-	log.Println("DAMInform.getWUR() ....")
+	log.Println("DAMInform.getWhereUsed() ....")
 
 	rows, err = db.Query(query, assetID)
 	if err != nil {
 		log.Println(err.Error())
-		return false
+		return wu, false
 	}
 	defer rows.Close()
 
-	orderpanels := []string{}
-	ordersets := []string{}
-	smartgroups := []string{}
-	others := []string{}
 	childname := ""
 	isReleasedRelationship := false
 
@@ -657,8 +1063,6 @@ func getWUR(report *string, Path string) bool {
 		parentid := ""
 		parentcid := []byte("") // declared this way to handle null values in Scan() 
 
-		//var parentcidnullable sql.NullString 
-
 		err = rows.Scan(
 			&parentname,
 			&parentid,
@@ -669,37 +1073,67 @@ func getWUR(report *string, Path string) bool {
 
 		if err != nil {
 			log.Println(err.Error())
-			return false
+			return wu, false
 		}
 
 		if isReleasedRelationship {
 			parentname += cRELEASEDVERSIONSUFFIX
 		}
-	
-/* 		if parentcidnullable.Valid {
-			parentcid, _ = parentcidnullable.Value()
-		}
 
- */		if strings.Contains(strings.ToLower(parentname), "order panel") {
+		entry := whereUsedEntry{Name: parentname, ID: parentid, CID: string(parentcid)}
+
+		if strings.Contains(strings.ToLower(parentname), "order panel") {
 			// add to the panel list
-			orderpanels = append(orderpanels, parentname+"~"+parentid+"~"+string(parentcid))
+			wu.OrderPanels = append(wu.OrderPanels, entry)
 		} else {
 			if strings.Contains(strings.ToLower(parentname), "smart group") {
 				// add to the panel list
-				smartgroups = append(smartgroups, parentname+"~"+parentid+"~"+string(parentcid))
+				wu.SmartGroups = append(wu.SmartGroups, entry)
 			} else {
 				if strings.Contains(strings.ToLower(parentname), "order set") {
 					// add to the panel list
-					ordersets = append(ordersets, parentname+"~"+parentid+"~"+string(parentcid))
+					wu.OrderSets = append(wu.OrderSets, entry)
 				} else {
 					// randoms
-					others = append(others, parentname+"~"+parentid+"~"+string(parentcid))
+					wu.Others = append(wu.Others, entry)
 				}
 			}
 
 		}
 
 	}
+
+	return wu, true
+}
+
+func getWUR(report *string, Path string) bool {
+
+	fmt.Println("DAMInform : getWUR() " + Path)
+
+	parts := strings.Split(Path, ",")
+
+	assetID := parts[1]
+
+	fmt.Println("DAMInform : getWUR() " + assetID)
+
+	wu, ok := getWhereUsed(assetID)
+	if !ok {
+		return false
+	}
+
+	assetdisplayname := wu.AssetName
+	orderpanels := wu.OrderPanels
+	ordersets := wu.OrderSets
+	smartgroups := wu.SmartGroups
+	others := wu.Others
+
+	tabledef := ""
+	tableheader := ""
+	tablebody := ""
+	columnnumber := 5
+
+	log.Println("DAMInform.getWUR() ....")
+
 	theTime := fmt.Sprintf("%s", time.Now().Format("Mon Jan _2 2006 @ 15:04"))
 	tableheader += "<thead>" +
 				"<tr>" +
@@ -728,10 +1162,9 @@ func getWUR(report *string, Path string) bool {
 
 	if len(orderpanels) > 0 {
 		for i := range orderpanels {
-			bits := strings.Split(orderpanels[i], "~")
-			name := bits[0]
-			id := bits[1]
-			childcid := bits[2]
+			name := orderpanels[i].Name
+			id := orderpanels[i].ID
+			childcid := orderpanels[i].CID
 
 			parents := getParents(id)
 			rowspan := len(parents)
@@ -769,10 +1202,9 @@ func getWUR(report *string, Path string) bool {
 	if len(smartgroups) > 0 {
 
 		for i := range smartgroups {
-			bits := strings.Split(smartgroups[i], "~")
-			name := bits[0]
-			id := bits[1]
-			childcid := bits[2]			
+			name := smartgroups[i].Name
+			id := smartgroups[i].ID
+			childcid := smartgroups[i].CID			
 			parents := getParents(id)
 
 			rowspan := len(parents)
@@ -807,11 +1239,10 @@ func getWUR(report *string, Path string) bool {
 
 	if len(ordersets) > 0 {
 		for i := range ordersets {
-			bits := strings.Split(ordersets[i], "~")
-			name := bits[0]
-			id := bits[1]
+			name := ordersets[i].Name
+			id := ordersets[i].ID
 			parents := getParents(id)
-			childcid := bits[2]						
+			childcid := ordersets[i].CID						
 			rowspan := len(parents)
 
 			tablebody += "<tr>"
@@ -848,10 +1279,9 @@ func getWUR(report *string, Path string) bool {
 
 	if len(others) > 0 {
 		for i := range others {
-			bits := strings.Split(others[i], "~")
-			name := bits[0]
-			id := bits[1]
-			childcid := bits[2]									
+			name := others[i].Name
+			id := others[i].ID
+			childcid := others[i].CID									
 			parents := getParents(id)
 			rowspan := len(parents)
 			tablebody += "<tr>"
@@ -1012,128 +1442,6 @@ func getLog(report *string) bool {
 
 }
 
-func doDispatch() bool {
-
-	// needs a place to store the last sent notifiaction
-	// select from queue where id > last sent
-
-	// for each row
-	// read values
-	// lookup owner -> email
-	// send email.
-	log.Println("DAMInform.doDispatch() ....")
-
-	lastid := -1
-	query := ""
-	theid := -1
-	result := false
-	//logMessage("Doing Notification Dispatch", "", "INFO")
-
-	query = `SELECT lastnotification
-		FROM public.state;`
-	rows, err := db.Query(query)
-	if err != nil {
-		if err, ok := err.(*pq.Error); ok {
-			fmt.Println("pq error:", err.Code.Name())
-			logMessage(fmt.Sprintf("Problems querying state : %s", err.Code.Name()), "", "ERROR")
-		}
-		return false
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		err = rows.Scan(
-			&lastid,
-		)
-	}
-
-	query = `SELECT id, "lead", message, asset, created, notifymgr, jirakey 
-			from notificationqueue
-			where id > $1
-			order by id asc`
-
-	rows, err = db.Query(query, lastid)
-	if err != nil {
-		if err, ok := err.(*pq.Error); ok {
-			fmt.Println("pq error:", err.Code.Name())
-			logMessage(fmt.Sprintf("Problems querying notifications[%d] : %s", lastid, err.Code.Name()), "", "ERROR")
-		}
-		return false
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		thebody := ""
-		thejirakey := ""
-		theasset := ""
-		notifymgr := false
-		lead := ""
-
-		var whencreated pq.NullTime
-
-		err = rows.Scan(
-			&theid,
-			&lead,
-
-			&thebody,
-			&theasset,
-			&whencreated,
-			&notifymgr,
-			&thejirakey,
-		)
-
-		if err != nil {
-			logMessage("Problems scanning notificationqueue"+err.Error(), "", "ERROR")
-		}
-
-		toperson := lead + "@ahs.ca"
-
-		m := gomail.NewMessage()
-		m.SetHeader("From", "noreply@ahs.ca", "DAM")
-		m.SetHeader("To", toperson)
-
-		if notifymgr {
-
-			results := strings.Split(sessionConfig.ManagersEmail, ",")
-			for _, email := range results {
-				logMessage("Notifying manager : "+email, "", "DEBUG")
-				m.SetAddressHeader("Cc", email, email)
-			}
-
-		}
-
-		m.SetHeader("Subject", sessionConfig.SubjectPrefix+"DAM: "+thejirakey)
-		m.SetBody("text/html", thebody)
-		//m.Attach("/home/Alex/lolcat.jpg")
-
-		d := gomail.NewDialer("mail", 25, "", "Hm3xU56U")
-		logMessage(fmt.Sprintf("Sending notification about %s to %s : %s", thejirakey, toperson, thebody), thejirakey, "DEBUG")
-
-		// Send the email
-		if err := d.DialAndSend(m); err != nil {
-			logMessage(fmt.Sprintf("Problems sending mail notification [%d] : %s", theid, err.Error()), thejirakey, "ERROR")
-			result = false
-			break
-		}
-
-	}
-
-	if theid > -1 {
-		// save a pointer to the last processed notification, so that we can pick up where we left off next time
-		_, err = db.Exec(`UPDATE public.state SET lastnotification = $1;`, theid)
-		if err != nil {
-			if err, ok := err.(*pq.Error); ok {
-				fmt.Println("pq error:", err.Code.Name())
-				logMessage(fmt.Sprintf("Problems updating state [%d] : %s", theid, err.Code.Name()), "", "ERROR")
-				return false
-			}
-		}
-
-	}
-
-	return result
-
-}
 func logMessage(message, ticket, logtype string) error {
 
 	sqlStatement := `
@@ -1148,7 +1456,8 @@ func logMessage(message, ticket, logtype string) error {
 // loads ticket metadata from database into struct param
 func getNotificationQueue(report *string) bool {
 
-	query := `	SELECT id, message, jirakey, asset, created, notifymgr
+	query := `	SELECT id, message, jirakey, asset, created, notifymgr, status, attempts, lasterror, sent, severity,
+		kind, acknowledged, acknowledgedby, escalation
 	FROM public.notificationqueue order by id desc
 	`
 
@@ -1176,6 +1485,15 @@ func getNotificationQueue(report *string) bool {
 		var notifymgr bool
 		var created pq.NullTime
 		var id int
+		status := ""
+		attempts := 0
+		lasterror := ""
+		var sent pq.NullTime
+		severity := ""
+		kind := ""
+		var acknowledged pq.NullTime
+		acknowledgedby := ""
+		escalation := 0
 
 		err = rows.Scan(
 			&id,
@@ -1184,6 +1502,15 @@ func getNotificationQueue(report *string) bool {
 			&asset,
 			&created,
 			&notifymgr,
+			&status,
+			&attempts,
+			&lasterror,
+			&sent,
+			&severity,
+			&kind,
+			&acknowledged,
+			&acknowledgedby,
+			&escalation,
 		)
 
 		if err != nil {
@@ -1199,6 +1526,16 @@ func getNotificationQueue(report *string) bool {
 		tablebody += fmt.Sprintf("<td>%s</td>", asset)
 		tablebody += fmt.Sprintf("<td>%s</td>", created.Time.Format("2006-01-02 15:04:05"))
 		tablebody += fmt.Sprintf("<td>%s</td>", strconv.FormatBool(notifymgr))
+		tablebody += fmt.Sprintf("<td>%s</td>", status)
+		tablebody += fmt.Sprintf("<td>%s</td>", severity)
+		tablebody += fmt.Sprintf("<td>%d</td>", attempts)
+		tablebody += fmt.Sprintf("<td>%s</td>", lasterror)
+		if sent.Valid {
+			tablebody += fmt.Sprintf("<td>%s</td>", sent.Time.Format("2006-01-02 15:04:05"))
+		} else {
+			tablebody += "<td></td>"
+		}
+		tablebody += fmt.Sprintf("<td>%s</td>", formatAckState(kind, acknowledged, acknowledgedby, escalation))
 
 		tablebody += "</tr>"
 	}
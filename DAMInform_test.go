@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// restores sessionConfig when the test ends, so that it can set whatever it needs. the copy is shallow:
+// replace slices and maps in the config rather than changing them in place.
+func useConfig(t *testing.T) {
+
+	t.Helper()
+
+	saved := sessionConfig
+	t.Cleanup(func() { sessionConfig = saved })
+}
+
+// points db at a postgres that isn't there, so code that logs to it fails quietly instead of panicking.
+func useUnreachableDB(t *testing.T) {
+
+	t.Helper()
+
+	unreachable, err := sql.Open("postgres", "host=127.0.0.1 port=1 user=test dbname=test sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := db
+	t.Cleanup(func() {
+		unreachable.Close()
+		db = saved
+	})
+	db = unreachable
+}
+
+func TestIsAdmin(t *testing.T) {
+
+	useConfig(t)
+
+	for _, c := range []struct {
+		configured string
+		target     string
+		header     string
+		want       bool
+	}{
+		{"", "/RunJob,dispatch", "", false}, // no token configured: closed, not open
+		{"", "/RunJob,dispatch?token=", "", false},
+		{"s3cret", "/RunJob,dispatch", "", false},
+		{"s3cret", "/RunJob,dispatch?token=wrong", "", false},
+		{"s3cret", "/RunJob,dispatch?token=s3cret", "", true},
+		{"s3cret", "/RunJob,dispatch", "s3cret", true},
+		{"s3cret", "/RunJob,dispatch", "S3CRET", false},
+	} {
+		sessionConfig.AdminToken = c.configured
+		r := httptest.NewRequest("POST", c.target, nil)
+		if c.header != "" {
+			r.Header.Set("X-DAMInform-Token", c.header)
+		}
+		if got := isAdmin(r); got != c.want {
+			t.Errorf("AdminToken %q, %s, header %q: isAdmin() = %v, want %v", c.configured, c.target, c.header, got, c.want)
+		}
+	}
+}
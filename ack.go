@@ -0,0 +1,269 @@
+// Notification and Dashboard Service for DAM
+//
+// acknowledgement and escalation: every notification carries a signed link to /Ack, and those left
+// unacknowledged are followed up with the lead, then the managers
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq" // golang postgres db driver
+)
+
+// the kind queued to follow up an unacknowledged notification
+const cKINDESCALATION = "escalation"
+
+// notificationqueue.escalation: how far an unacknowledged notification has been followed up
+const (
+	cESCALATIONNONE     = 0
+	cESCALATIONLEAD     = 1 // the lead has been reminded
+	cESCALATIONMANAGERS = 2 // the managers have been told
+)
+
+// signs ack links when no AckSecret is configured; such links stop working when DAMInform restarts.
+var ackSecret []byte
+
+func initAck() {
+
+	if sessionConfig.AckSecret != "" {
+		ackSecret = []byte(sessionConfig.AckSecret)
+		return
+	}
+
+	ackSecret = make([]byte, 32)
+	if _, err := rand.Read(ackSecret); err != nil {
+		panic(err)
+	}
+	logMessage("Ack: no AckSecret configured, acknowledge links will not survive a restart", "", "ERROR")
+}
+
+// true for the kinds of notification that ask to be acknowledged.
+func needsAck(kind string) bool {
+
+	switch kind {
+	case cKINDRESOLVED, cKINDDIGEST, cKINDESCALATION:
+		return false
+	}
+
+	return true
+}
+
+func ackSignature(id int) string {
+
+	mac := hmac.New(sha256.New, ackSecret)
+	mac.Write([]byte("ack:" + strconv.Itoa(id)))
+
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// the link that acknowledges a notification.
+func ackLink(id int) string {
+	return fmt.Sprintf("%s/Ack,%d,%s", strings.TrimSuffix(sessionConfig.BaseURL, "/"), id, ackSignature(id))
+}
+
+// the page behind an ack link. GET asks who is acknowledging, so that mail scanners following
+// links don't acknowledge anything; POST records it.
+func handleAck(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(strings.Trim(r.URL.Path, "/"), ",")
+	if len(params) < 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.Trim(params[1], "/"))
+	signature := strings.Trim(params[2], "/")
+	if err != nil || !hmac.Equal([]byte(signature), []byte(ackSignature(id))) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "this acknowledge link is not valid")
+		return
+	}
+
+	jirakey := ""
+	lead := ""
+	message := ""
+	ackedby := ""
+	var acknowledged pq.NullTime
+
+	err = db.QueryRow(`SELECT jirakey, "lead", message, acknowledgedby, acknowledged
+		FROM public.notificationqueue WHERE id = $1`, id).Scan(&jirakey, &lead, &message, &ackedby, &acknowledged)
+	if err != nil {
+		log.Println(err.Error())
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "POST" && !acknowledged.Valid {
+
+		ackedby = strings.TrimSpace(r.FormValue("by"))
+		if ackedby == "" {
+			ackedby = lead
+		}
+
+		if !acknowledgeNotification(id, ackedby, clientAddress(r)) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		acknowledged = pq.NullTime{Time: time.Now(), Valid: true}
+	}
+
+	page := "<html><body style='font-family: Lato, Arial, sans-serif; color: #333;'>"
+	page += fmt.Sprintf("<h3>%s</h3><p>%s</p>", html.EscapeString(jirakey), message)
+	if acknowledged.Valid {
+		page += fmt.Sprintf("<p>Acknowledged by %s on %s.</p>", html.EscapeString(ackedby), acknowledged.Time.Format("Mon Jan _2 2006 @ 15:04"))
+	} else {
+		page += fmt.Sprintf(`<form method="post" action="%s">
+			<label>Acknowledged by <input name="by" value="%s"></label>
+			<button type="submit">Acknowledge</button>
+			</form>`, environmentPath(fmt.Sprintf("/Ack,%d,%s", id, signature)), html.EscapeString(lead))
+	}
+	page += "</body></html>"
+
+	fmt.Fprint(w, page)
+}
+
+// records who acknowledged a notification; the first acknowledgement stands.
+func acknowledgeNotification(id int, by, from string) bool {
+
+	_, err := db.Exec(`UPDATE public.notificationqueue
+		SET acknowledged = $1, acknowledgedby = $2
+		WHERE id = $3 and acknowledged is null`, time.Now(), by, id)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems acknowledging notification [%d] : %s", id, err.Code.Name()), "", "ERROR")
+		}
+		return false
+	}
+
+	logMessage(fmt.Sprintf("Notification [%d] acknowledged by %s from %s", id, by, from), "", "INFO")
+
+	return true
+}
+
+// follows up notifications still unacknowledged: a reminder to the lead after EscalateLeadAfterHours,
+// then the managers are copied after EscalateManagersAfterHours - in a later run than the reminder,
+// so the lead always gets a chance to acknowledge first. Either stage is skipped when its hours are 0.
+func doEscalation(ctx context.Context) (string, error) {
+
+	log.Println("DAMInform.doEscalation() ....")
+
+	stages := []struct {
+		escalation int
+		after      time.Duration
+		notifymgr  bool
+		message    string
+	}{
+		{cESCALATIONLEAD, time.Duration(*sessionConfig.EscalateLeadAfterHours) * time.Hour, false,
+			"This notification has not been acknowledged yet."},
+		{cESCALATIONMANAGERS, time.Duration(*sessionConfig.EscalateManagersAfterHours) * time.Hour, true,
+			"This notification has still not been acknowledged, so it has been passed to the managers."},
+	}
+
+	escalated := 0
+	escalatedNow := make(map[int]bool) // reminded in this run, the managers wait for the next
+	previous := cESCALATIONNONE        // the stage a notification must have reached first
+
+	for _, stage := range stages {
+
+		if stage.after <= 0 {
+			continue
+		}
+
+		rows, err := db.Query(`SELECT id, "lead", message, jirakey, asset, kind, sent
+			FROM public.notificationqueue
+			WHERE status in ($1, $2) and acknowledged is null and escalation >= $3 and escalation < $4 and sent < $5
+			  and kind not in ($6, $7, $8)
+			ORDER BY id`,
+			cSTATUSSENT, cSTATUSDIGEST, previous, stage.escalation, time.Now().Add(-stage.after),
+			cKINDRESOLVED, cKINDDIGEST, cKINDESCALATION)
+		if err != nil {
+			if err, ok := err.(*pq.Error); ok {
+				fmt.Println("pq error:", err.Code.Name())
+				logMessage(fmt.Sprintf("Problems querying unacknowledged notifications : %s", err.Code.Name()), "", "ERROR")
+			}
+			return "", err
+		}
+
+		due := []queuedNotification{}
+		for rows.Next() {
+			n := queuedNotification{}
+			var sent pq.NullTime
+			if err = rows.Scan(&n.ID, &n.Lead, &n.Message, &n.JiraKey, &n.Asset, &n.Kind, &sent); err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			n.Created = sent.Time
+			due = append(due, n)
+		}
+		rows.Close()
+
+		previous = stage.escalation
+
+		for _, n := range due {
+
+			if ctx.Err() != nil {
+				return fmt.Sprintf("%d notifications escalated", escalated), ctx.Err()
+			}
+			if escalatedNow[n.ID] {
+				continue
+			}
+
+			message := fmt.Sprintf("<p>%s It was sent %s.</p>%s",
+				stage.message, n.Created.Format("Mon Jan _2 2006 @ 15:04"), n.Message)
+
+			_, err = db.Exec(`INSERT INTO public.notificationqueue
+				(message, jirakey, asset, created, notifymgr, lead, kind, escalates)
+				VALUES( $1, $2, $3, $4, $5, $6, $7, $8);`,
+				message, n.JiraKey, n.Asset, time.Now(), stage.notifymgr, n.Lead, cKINDESCALATION, n.ID)
+			if err, ok := err.(*pq.Error); ok {
+				logMessage("pq error:"+err.Code.Name()+" - "+err.Message, n.JiraKey, "ERROR")
+				continue
+			}
+
+			_, err = db.Exec(`UPDATE public.notificationqueue SET escalation = $1 WHERE id = $2`, stage.escalation, n.ID)
+			if err, ok := err.(*pq.Error); ok {
+				logMessage("pq error:"+err.Code.Name()+" - "+err.Message, n.JiraKey, "ERROR")
+				continue
+			}
+
+			escalatedNow[n.ID] = true
+			escalated++
+		}
+	}
+
+	return fmt.Sprintf("%d notifications escalated", escalated), nil
+}
+
+// how far along a notification is, for the queue report.
+func formatAckState(kind string, acknowledged pq.NullTime, ackedby string, escalation int) string {
+
+	if acknowledged.Valid {
+		return fmt.Sprintf("acknowledged by %s %s", html.EscapeString(ackedby), acknowledged.Time.Format("2006-01-02 15:04:05"))
+	}
+	if !needsAck(kind) {
+		return ""
+	}
+
+	switch escalation {
+	case cESCALATIONLEAD:
+		return "unacknowledged, lead reminded"
+	case cESCALATIONMANAGERS:
+		return "unacknowledged, managers told"
+	}
+
+	return "unacknowledged"
+}
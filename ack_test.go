@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// signs with a known secret for the length of a test.
+func useAckSecret(t *testing.T, secret string) {
+
+	t.Helper()
+
+	saved := ackSecret
+	t.Cleanup(func() { ackSecret = saved })
+	ackSecret = []byte(secret)
+}
+
+func TestAckSignature(t *testing.T) {
+
+	useAckSecret(t, "test secret")
+
+	signature := ackSignature(42)
+	if len(signature) != 32 {
+		t.Errorf("signature %q is %d characters, want 32", signature, len(signature))
+	}
+	if ackSignature(42) != signature {
+		t.Error("signing the same id twice gave different signatures")
+	}
+	if ackSignature(43) == signature {
+		t.Error("ids 42 and 43 have the same signature")
+	}
+
+	ackSecret = []byte("another secret")
+	if ackSignature(42) == signature {
+		t.Error("a different secret gave the same signature")
+	}
+}
+
+func TestAckLink(t *testing.T) {
+
+	useAckSecret(t, "test secret")
+
+	useConfig(t)
+	sessionConfig.BaseURL = "http://daminform:9011/"
+
+	want := fmt.Sprintf("http://daminform:9011/Ack,7,%s", ackSignature(7))
+	if got := ackLink(7); got != want {
+		t.Errorf("ackLink(7) = %q, want %q", got, want)
+	}
+}
+
+func TestHandleAckRefusesBadLinks(t *testing.T) {
+
+	useAckSecret(t, "test secret")
+
+	for _, c := range []struct {
+		path string
+		want int
+	}{
+		{"/Ack,42", http.StatusBadRequest},
+		{"/Ack,42,0123456789abcdef0123456789abcdef", http.StatusForbidden},
+		{"/Ack,43," + ackSignature(42), http.StatusForbidden}, // another notification's signature
+		{"/Ack,x," + ackSignature(42), http.StatusForbidden},
+		{"/Ack,42," + strings.ToUpper(ackSignature(42)), http.StatusForbidden},
+	} {
+		for _, method := range []string{"GET", "POST"} {
+			w := httptest.NewRecorder()
+			handleAck(w, httptest.NewRequest(method, c.path, nil))
+			if w.Code != c.want {
+				t.Errorf("%s %s: status %d, want %d", method, c.path, w.Code, c.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Notification and Dashboard Service for DAM
+//
+// asset types: the kinds of file the changeset repository holds that DAMInform tracks - templates, operational
+// templates, archetypes - each with its extension, the folders and files to leave alone, and how it matches damasset
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// assetType.Damasset values
+const (
+	cDAMASSETFILENAME = "filename" // damasset.filename is the file's name
+	cDAMASSETSTEM     = "stem"     // damasset.filename is the file's name without the extension
+	cDAMASSETNONE     = "none"     // not in damasset; walked and counted, never a problem
+)
+
+// one tracked kind of file, from config.AssetTypes
+type assetType struct {
+	Name      string   // e.g. template
+	Extension string   // e.g. .oet
+	Ignore    []string // filepath.Match patterns for folder or file names under a ticket, e.g. downloads
+	Damasset  string   // how a file matches its damasset row, filename (the default), stem or none
+	Format    string   // oet: deep checks read the file as a Template Designer template; the default for .oet
+}
+
+// templates, as DAMInform always tracked them, when config.json has no AssetTypes
+func setAssetTypeDefaults() {
+
+	if len(sessionConfig.AssetTypes) == 0 {
+		sessionConfig.AssetTypes = []assetType{{Name: "template", Extension: ".oet", Ignore: []string{"downloads"}}}
+	}
+
+	for i := range sessionConfig.AssetTypes {
+		t := &sessionConfig.AssetTypes[i]
+		t.Extension = strings.ToLower(t.Extension)
+		if t.Extension != "" && !strings.HasPrefix(t.Extension, ".") {
+			t.Extension = "." + t.Extension
+		}
+		if t.Name == "" {
+			t.Name = strings.TrimPrefix(t.Extension, ".")
+		}
+		if t.Damasset == "" {
+			t.Damasset = cDAMASSETFILENAME
+		}
+		if t.Format == "" && t.Extension == ".oet" {
+			t.Format = cFORMATOET
+		}
+	}
+}
+
+// the type of the file at rel, a path relative to the changeset repository or a ticket folder;
+// ok is false for files no type tracks, or that every type they could be ignores.
+func assetTypeOf(rel string) (assetType, bool) {
+
+	ext := strings.ToLower(filepath.Ext(rel))
+
+	for _, t := range sessionConfig.AssetTypes {
+		if t.Extension == ext && !t.ignores(rel) {
+			return t, true
+		}
+	}
+
+	return assetType{}, false
+}
+
+// whether any part of rel matches one of the type's ignore patterns.
+func (t assetType) ignores(rel string) bool {
+
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		for _, pattern := range t.Ignore {
+			if matched, _ := filepath.Match(pattern, part); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// whether a folder can be left out of a walk: every type ignores it.
+func ignoredFolder(name string) bool {
+
+	for _, t := range sessionConfig.AssetTypes {
+		if !t.ignores(name) {
+			return false
+		}
+	}
+
+	return len(sessionConfig.AssetTypes) > 0
+}
+
+// the filename the damasset row for asset has; false when the type is not kept in damasset.
+func (t assetType) damassetFilename(asset string) (string, bool) {
+
+	switch t.Damasset {
+	case cDAMASSETNONE:
+		return "", false
+	case cDAMASSETSTEM:
+		return strings.TrimSuffix(asset, filepath.Ext(asset)), true
+	default:
+		return asset, true
+	}
+}
+
+// an asset's name without the extension of its type, for reports and emails.
+func assetDisplayName(asset string) string {
+
+	if _, ok := assetTypeOf(asset); ok {
+		return strings.TrimSuffix(asset, filepath.Ext(asset))
+	}
+
+	return asset
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// the asset types for a test, with the defaults config.json would get filled in.
+func useAssetTypes(t *testing.T, types ...assetType) {
+
+	t.Helper()
+
+	useConfig(t)
+	sessionConfig.AssetTypes = types
+	setAssetTypeDefaults()
+}
+
+func TestSetAssetTypeDefaults(t *testing.T) {
+
+	useAssetTypes(t)
+	want := []assetType{{Name: "template", Extension: ".oet", Ignore: []string{"downloads"}, Damasset: cDAMASSETFILENAME, Format: cFORMATOET}}
+	if !reflect.DeepEqual(sessionConfig.AssetTypes, want) {
+		t.Errorf("with no AssetTypes: %+v, want %+v", sessionConfig.AssetTypes, want)
+	}
+
+	useAssetTypes(t, assetType{Extension: "ADL"})
+	got := sessionConfig.AssetTypes[0]
+	if got.Extension != ".adl" || got.Name != "adl" || got.Damasset != cDAMASSETFILENAME || got.Format != "" {
+		t.Errorf("extension only: %+v", got)
+	}
+}
+
+func TestAssetTypeOf(t *testing.T) {
+
+	useAssetTypes(t,
+		assetType{Name: "template", Extension: ".oet", Ignore: []string{"downloads", "*.bak"}},
+		assetType{Name: "operational template", Extension: ".opt"},
+		assetType{Name: "archetype", Extension: ".adl", Ignore: []string{"drafts"}},
+	)
+
+	for _, c := range []struct {
+		rel  string
+		want string // the type's name, untracked if empty
+	}{
+		{"CSDFK-1234/Sepsis.oet", "template"},
+		{"CSDFK-1234/SEPSIS.OET", "template"},
+		{"Sepsis.oet", "template"},
+		{"CSDFK-1234/downloads/Sepsis.oet", ""},
+		{"CSDFK-1234/downloads/Sepsis.opt", "operational template"}, // only templates ignore downloads
+		{"CSDFK-1234/old.bak/Sepsis.oet", ""},
+		{"CSDFK-1234/openEHR-EHR-OBSERVATION.news2.v1.adl", "archetype"},
+		{"CSDFK-1234/drafts/openEHR-EHR-OBSERVATION.news2.v1.adl", ""},
+		{"CSDFK-1234/notes.txt", ""},
+		{"CSDFK-1234/Sepsis", ""},
+	} {
+		got, ok := assetTypeOf(c.rel)
+		if ok != (c.want != "") || got.Name != c.want {
+			t.Errorf("assetTypeOf(%q) = %q, %v, want %q", c.rel, got.Name, ok, c.want)
+		}
+	}
+}
+
+func TestIgnoredFolder(t *testing.T) {
+
+	useAssetTypes(t,
+		assetType{Name: "template", Extension: ".oet", Ignore: []string{"downloads", "tmp*"}},
+		assetType{Name: "operational template", Extension: ".opt", Ignore: []string{"tmp*"}},
+	)
+
+	for _, c := range []struct {
+		name string
+		want bool
+	}{
+		{"tmp", true},
+		{"tmp-2024", true},
+		{"downloads", false}, // operational templates are still wanted there
+		{"CSDFK-1234", false},
+	} {
+		if got := ignoredFolder(c.name); got != c.want {
+			t.Errorf("ignoredFolder(%q) = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	useConfig(t)
+	sessionConfig.AssetTypes = nil
+	if ignoredFolder("tmp") {
+		t.Error("a folder is ignored when no type is tracked")
+	}
+}
+
+func TestDamassetFilename(t *testing.T) {
+
+	for _, c := range []struct {
+		damasset string
+		want     string
+		ok       bool
+	}{
+		{cDAMASSETFILENAME, "Sepsis.oet", true},
+		{cDAMASSETSTEM, "Sepsis", true},
+		{cDAMASSETNONE, "", false},
+	} {
+		got, ok := assetType{Extension: ".oet", Damasset: c.damasset}.damassetFilename("Sepsis.oet")
+		if got != c.want || ok != c.ok {
+			t.Errorf("%s: damassetFilename() = %q, %v, want %q, %v", c.damasset, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestAssetDisplayName(t *testing.T) {
+
+	useAssetTypes(t)
+
+	for _, c := range []struct {
+		asset string
+		want  string
+	}{
+		{"Sepsis Screening.oet", "Sepsis Screening"},
+		{"Sepsis.v2.oet", "Sepsis.v2"},
+		{"notes.txt", "notes.txt"}, // not a tracked type, so the extension says something
+	} {
+		if got := assetDisplayName(c.asset); got != c.want {
+			t.Errorf("assetDisplayName(%q) = %q, want %q", c.asset, got, c.want)
+		}
+	}
+}
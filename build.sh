@@ -1,3 +1,3 @@
-go build -ldflags "-X main.gBuild=`date -u +.%Y%m%d.%H%M%S`" ./DAMInform.go 
+go build -ldflags "-X main.gBuild=`date -u +.%Y%m%d.%H%M%S`" -o DAMInform . 
 scp ./DAMInform coni@beeby.ca:~/
 ./DAMInform -v
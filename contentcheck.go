@@ -0,0 +1,133 @@
+// Notification and Dashboard Service for DAM
+//
+// content-level integrity: the deep check fingerprints each tracked asset (size, mtime, sha256) and reports
+// files whose content changed on disk while damasset still says they are unmodified
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/lib/pq" // golang postgres db driver
+)
+
+// integrityProblem.Kind for a file changed on disk without damasset.modified being set
+const cPROBLEMCONTENTDRIFT = "content drift"
+
+// what an asset looked like at the last deep check, from public.assetfingerprint
+type assetFingerprint struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	SHA256   string    `json:"sha256"`
+	Modified bool      `json:"modified"` // damasset.modified when it was recorded
+}
+
+// the fingerprints recorded by earlier deep checks, by folder~filename.
+func getAssetFingerprints() (map[string]assetFingerprint, bool) {
+
+	fingerprints := make(map[string]assetFingerprint)
+
+	rows, err := db.Query(`SELECT folder, filename, size, mtime, sha256, modified FROM public.assetfingerprint`)
+	if err != nil {
+		log.Println(err.Error())
+		return fingerprints, false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		folder := ""
+		filename := ""
+		f := assetFingerprint{}
+		if err = rows.Scan(&folder, &filename, &f.Size, &f.ModTime, &f.SHA256, &f.Modified); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		fingerprints[folder+"~"+filename] = f
+	}
+
+	return fingerprints, true
+}
+
+func (f assetFingerprint) same(g assetFingerprint) bool {
+	return f.Size == g.Size && f.ModTime.Equal(g.ModTime) && f.SHA256 == g.SHA256 && f.Modified == g.Modified
+}
+
+func fingerprintFile(path string, info os.FileInfo) (assetFingerprint, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return assetFingerprint{}, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return assetFingerprint{}, err
+	}
+
+	return newFingerprint(info, h), nil
+}
+
+// the fingerprint of a file whose whole content h has been given.
+func newFingerprint(info os.FileInfo, h hash.Hash) assetFingerprint {
+	return assetFingerprint{Size: info.Size(), ModTime: info.ModTime().UTC().Truncate(time.Microsecond), SHA256: hex.EncodeToString(h.Sum(nil))}
+}
+
+// compares a tracked file's current fingerprint with its last. content that changed while damasset says unmodified,
+// both then and now, is drift; it stays reported until damasset catches up or the baseline is reset.
+// otherwise the fingerprint becomes the new baseline.
+func checkAssetContent(result *integrityResult, row damassetRow, path string, current assetFingerprint, fingerprints map[string]assetFingerprint) {
+
+	key := row.Folder + "~" + row.Filename
+	result.Content.Checked++
+
+	current.Modified = row.Modified
+
+	previous, known := fingerprints[key]
+
+	if known && !result.Rebaseline && previous.SHA256 != current.SHA256 && !previous.Modified && !row.Modified {
+		damasset := row
+		result.addProblem(integrityProblem{
+			Ticket:   row.Folder,
+			Asset:    row.Filename,
+			Kind:     cPROBLEMCONTENTDRIFT,
+			Path:     path,
+			DamAsset: &damasset,
+			Detail: fmt.Sprintf("size %d -> %d, modified %s -> %s, sha256 %.12s -> %.12s",
+				previous.Size, current.Size,
+				previous.ModTime.Format("2006-01-02 15:04:05"), current.ModTime.Format("2006-01-02 15:04:05"),
+				previous.SHA256, current.SHA256),
+		})
+		logMessage("INTEGRITY: "+result.Environment+" - changed on disk, not marked modified in damasset: "+row.Filename, row.Folder, "ERROR")
+		return
+	}
+
+	if known && previous.same(current) {
+		return
+	}
+
+	_, err := db.Exec(`INSERT INTO public.assetfingerprint
+		(folder, filename, size, mtime, sha256, modified, recorded)
+		VALUES($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (folder, filename) DO UPDATE
+		SET size = excluded.size, mtime = excluded.mtime, sha256 = excluded.sha256, modified = excluded.modified, recorded = excluded.recorded`,
+		row.Folder, row.Filename, current.Size, current.ModTime, current.SHA256, current.Modified, time.Now())
+	if err, ok := err.(*pq.Error); ok {
+		fmt.Println("pq error:", err.Code.Name())
+		logMessage(fmt.Sprintf("Problems recording fingerprint of %s : %s", key, err.Code.Name()), row.Folder, "ERROR")
+		return
+	}
+
+	if known {
+		result.Content.Updated++
+	} else {
+		result.Content.Baselined++
+	}
+}
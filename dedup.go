@@ -0,0 +1,219 @@
+// Notification and Dashboard Service for DAM
+//
+// duplicate suppression: the same kind of notification about the same ticket and asset goes to a
+// recipient at most once per window, and the next one says how often it was seen in between.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/lib/pq" // golang postgres db driver
+)
+
+// notificationqueue.status for a row swallowed as a duplicate
+const cSTATUSSUPPRESSED = "suppressed"
+
+// the kind queued when a problem that was being notified about goes away
+const cKINDRESOLVED = "resolved"
+
+// the suppression window for a kind of notification: config.DedupWindowMinutes[kind], else its "*" entry.
+// zero means every notification of that kind is sent.
+func dedupWindow(kind string) time.Duration {
+
+	minutes, ok := sessionConfig.DedupWindowMinutes[kind]
+	if !ok {
+		minutes = sessionConfig.DedupWindowMinutes["*"]
+	}
+
+	return time.Duration(minutes) * time.Minute
+}
+
+// the key a recipient's dedup rows are held under: the bare address, lower case, so that a lead, a manager
+// and a subscriber who are the same person count once.
+func dedupRecipient(r notificationRecipient) string {
+
+	if address, err := mail.ParseAddress(r.address); err == nil {
+		return strings.ToLower(address.Address)
+	}
+
+	return strings.ToLower(r.address)
+}
+
+// a recipient's notificationdedup row for a kind of notification about a ticket and asset
+type dedupState struct {
+	lastsent   pq.NullTime
+	suppressed int
+	open       bool
+}
+
+// splits a notification's recipients into those to tell and the duplicates: those already told of the same kind of
+// notification about the same ticket and asset within its window. n.Repeats says how many duplicates were swallowed
+// since those told last heard of it. changes nothing, so previews use it too.
+func filterDuplicates(n *queuedNotification, recipients []notificationRecipient) (tell, duplicates []notificationRecipient) {
+
+	window := dedupWindow(n.Kind)
+	if n.Kind == cKINDRESOLVED || window <= 0 {
+		return recipients, nil
+	}
+
+	return splitDuplicates(n, recipients, getDedupStates(*n, recipients), window, time.Now())
+}
+
+// the dedup rows of a notification's recipients, by dedupRecipient(). none when they can't be read, so that
+// everyone is told rather than no one.
+func getDedupStates(n queuedNotification, recipients []notificationRecipient) map[string]dedupState {
+
+	states := make(map[string]dedupState)
+
+	keys := []string{}
+	for _, r := range recipients {
+		keys = append(keys, dedupRecipient(r))
+	}
+
+	rows, err := db.Query(`SELECT recipient, lastsent, suppressed, open FROM public.notificationdedup
+		WHERE kind = $1 and jirakey = $2 and asset = $3 and recipient = ANY($4)`,
+		n.Kind, n.JiraKey, n.Asset, pq.Array(keys))
+	if err != nil {
+		log.Println(err.Error())
+		return states
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		recipient := ""
+		state := dedupState{}
+		if err = rows.Scan(&recipient, &state.lastsent, &state.suppressed, &state.open); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		states[recipient] = state
+	}
+
+	return states
+}
+
+// filterDuplicates() on the dedup rows it read, as of now. each person is considered once, whichever of
+// their addresses and roles comes first.
+func splitDuplicates(n *queuedNotification, recipients []notificationRecipient, states map[string]dedupState,
+	window time.Duration, now time.Time) (tell, duplicates []notificationRecipient) {
+
+	seen := make(map[string]bool)
+
+	for _, r := range recipients {
+
+		recipient := dedupRecipient(r)
+		if seen[recipient] {
+			continue
+		}
+		seen[recipient] = true
+
+		state, ok := states[recipient]
+		if !ok || !state.open {
+			tell = append(tell, r)
+			continue
+		}
+
+		if state.lastsent.Valid && now.Sub(state.lastsent.Time) < window {
+			duplicates = append(duplicates, r)
+			continue
+		}
+
+		if state.suppressed > 0 && state.suppressed+1 > n.Repeats {
+			n.Repeats = state.suppressed + 1
+			n.RepeatsSince = state.lastsent.Time
+		}
+		tell = append(tell, r)
+	}
+
+	return tell, duplicates
+}
+
+// counts the duplicate for each recipient it was kept from.
+func countDuplicates(n queuedNotification, duplicates []notificationRecipient) {
+
+	for _, r := range duplicates {
+		_, err := db.Exec(`UPDATE public.notificationdedup SET suppressed = suppressed + 1
+			WHERE kind = $1 and jirakey = $2 and asset = $3 and recipient = $4`,
+			n.Kind, n.JiraKey, n.Asset, dedupRecipient(r))
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems counting duplicate notification [%d] : %s", n.ID, err.Code.Name()), n.JiraKey, "ERROR")
+		}
+	}
+}
+
+// starts a new window from now for each recipient told, with nothing suppressed yet.
+func recordNotified(n queuedNotification, told []notificationRecipient) {
+
+	if n.Kind == cKINDRESOLVED || dedupWindow(n.Kind) <= 0 {
+		return
+	}
+
+	for _, r := range told {
+		_, err := db.Exec(`INSERT INTO public.notificationdedup
+			(kind, jirakey, asset, recipient, notifymgr, firstseen, lastsent, suppressed, open)
+			VALUES($1, $2, $3, $4, $5, $6, $6, 0, true)
+			ON CONFLICT (kind, jirakey, asset, recipient) DO UPDATE
+			SET lastsent = excluded.lastsent, suppressed = 0, notifymgr = excluded.notifymgr, open = true,
+				firstseen = CASE WHEN notificationdedup.open THEN notificationdedup.firstseen ELSE excluded.firstseen END`,
+			n.Kind, n.JiraKey, n.Asset, dedupRecipient(r), r.manager, time.Now())
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems recording notification [%d] for suppression : %s", n.ID, err.Code.Name()), n.JiraKey, "ERROR")
+		}
+	}
+}
+
+// the problem behind a kind of notification has gone away: every address that was told about it
+// gets one "resolved" notification, and the next occurrence starts afresh.
+func resolveNotifications(kind, jirakey, asset, message string) {
+
+	rows, err := db.Query(`SELECT recipient, firstseen FROM public.notificationdedup
+		WHERE kind = $1 and jirakey = $2 and asset = $3 and open`, kind, jirakey, asset)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	type openProblem struct {
+		recipient string
+		firstseen pq.NullTime
+	}
+	open := []openProblem{}
+
+	for rows.Next() {
+		p := openProblem{}
+		if err = rows.Scan(&p.recipient, &p.firstseen); err == nil {
+			open = append(open, p)
+		}
+	}
+	rows.Close()
+
+	for _, p := range open {
+
+		_, err = db.Exec(`INSERT INTO public.notificationqueue
+			(message, jirakey, asset, created, notifymgr, lead, kind)
+			VALUES( $1, $2, $3, $4, $5, $6, $7);`,
+			fmt.Sprintf("%s (first reported %s)", message, p.firstseen.Time.Format("2006-01-02 15:04")),
+			jirakey, asset, time.Now(), false, p.recipient, cKINDRESOLVED)
+		if err, ok := err.(*pq.Error); ok {
+			logMessage("pq error:"+err.Code.Name()+" - "+err.Message, jirakey, "ERROR")
+			continue
+		}
+
+		_, err = db.Exec(`UPDATE public.notificationdedup SET open = false, suppressed = 0
+			WHERE kind = $1 and jirakey = $2 and asset = $3 and recipient = $4`, kind, jirakey, asset, p.recipient)
+		if err, ok := err.(*pq.Error); ok {
+			logMessage("pq error:"+err.Code.Name()+" - "+err.Message, jirakey, "ERROR")
+		}
+	}
+
+	if len(open) > 0 {
+		logMessage(fmt.Sprintf("%s resolved, %d recipients notified", kind, len(open)), jirakey, "INFO")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestDedupRecipient(t *testing.T) {
+
+	for _, c := range []struct {
+		address string
+		want    string
+	}{
+		{"jsmith@example.com", "jsmith@example.com"},
+		{"JSmith@Example.com", "jsmith@example.com"},
+		{"John Smith <JSmith@example.com>", "jsmith@example.com"},
+		{`"Smith, John" <jsmith@example.com>`, "jsmith@example.com"},
+		{"jsmith", "jsmith"}, // not an address: kept as it is, lower case
+		{"", ""},
+	} {
+		if got := dedupRecipient(notificationRecipient{address: c.address}); got != c.want {
+			t.Errorf("dedupRecipient(%q) = %q, want %q", c.address, got, c.want)
+		}
+	}
+}
+
+// the addresses of recipients, in order.
+func recipientAddresses(recipients []notificationRecipient) []string {
+
+	addresses := []string{}
+	for _, r := range recipients {
+		addresses = append(addresses, r.address)
+	}
+
+	return addresses
+}
+
+func TestSplitDuplicates(t *testing.T) {
+
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	sent := func(ago time.Duration, suppressed int, open bool) dedupState {
+		return dedupState{lastsent: pq.NullTime{Time: now.Add(-ago), Valid: true}, suppressed: suppressed, open: open}
+	}
+
+	lead := notificationRecipient{address: "Lead <lead@example.com>"}
+	manager := notificationRecipient{address: "manager@example.com", manager: true}
+	subscriber := notificationRecipient{address: "sub@example.com"}
+
+	for _, c := range []struct {
+		name       string
+		recipients []notificationRecipient
+		states     map[string]dedupState
+		tell       []string
+		duplicates []string
+		repeats    int
+	}{
+		{
+			"never told",
+			[]notificationRecipient{lead, manager},
+			map[string]dedupState{},
+			[]string{lead.address, manager.address}, []string{}, 0,
+		},
+		{
+			"told within the window",
+			[]notificationRecipient{lead, manager},
+			map[string]dedupState{"lead@example.com": sent(time.Hour, 0, true)},
+			[]string{manager.address}, []string{lead.address}, 0,
+		},
+		{
+			"told before the window, with duplicates swallowed since",
+			[]notificationRecipient{lead, subscriber},
+			map[string]dedupState{"lead@example.com": sent(3*time.Hour, 4, true), "sub@example.com": sent(5*time.Hour, 2, true)},
+			[]string{lead.address, subscriber.address}, []string{}, 5,
+		},
+		{
+			"resolved since, so told afresh",
+			[]notificationRecipient{lead},
+			map[string]dedupState{"lead@example.com": sent(time.Minute, 3, false)},
+			[]string{lead.address}, []string{}, 0,
+		},
+		{
+			"the same person as lead and manager counts once",
+			[]notificationRecipient{lead, {address: "LEAD@example.com", manager: true}},
+			map[string]dedupState{},
+			[]string{lead.address}, []string{}, 0,
+		},
+		{
+			"a duplicate as lead is not told as manager",
+			[]notificationRecipient{lead, {address: "lead@example.com", manager: true}},
+			map[string]dedupState{"lead@example.com": sent(time.Hour, 0, true)},
+			[]string{}, []string{lead.address}, 0,
+		},
+	} {
+		n := queuedNotification{Kind: cKINDINTEGRITY}
+		tell, duplicates := splitDuplicates(&n, c.recipients, c.states, 2*time.Hour, now)
+
+		if got := recipientAddresses(tell); !reflect.DeepEqual(got, c.tell) {
+			t.Errorf("%s: told %v, want %v", c.name, got, c.tell)
+		}
+		if got := recipientAddresses(duplicates); !reflect.DeepEqual(got, c.duplicates) {
+			t.Errorf("%s: duplicates %v, want %v", c.name, got, c.duplicates)
+		}
+		if n.Repeats != c.repeats {
+			t.Errorf("%s: repeats %d, want %d", c.name, n.Repeats, c.repeats)
+		}
+	}
+}
+
+func TestFilterDuplicatesWithoutAWindow(t *testing.T) {
+
+	useConfig(t)
+	sessionConfig.DedupWindowMinutes = map[string]int{"*": 60, cKINDHEARTBEAT: 0}
+
+	recipients := []notificationRecipient{{address: "lead@example.com"}, {address: "lead@example.com", manager: true}}
+
+	// no window, or a resolved notification: everyone is told, without looking anything up
+	for _, kind := range []string{cKINDHEARTBEAT, cKINDRESOLVED} {
+		n := queuedNotification{Kind: kind}
+		tell, duplicates := filterDuplicates(&n, recipients)
+		if len(tell) != 2 || len(duplicates) != 0 {
+			t.Errorf("%s: told %v, duplicates %v, want everyone told", kind, tell, duplicates)
+		}
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+
+	useConfig(t)
+	sessionConfig.DedupWindowMinutes = map[string]int{"*": 60, cKINDHEARTBEAT: 1440, cKINDGRAPH: 0}
+
+	for _, c := range []struct {
+		kind string
+		want time.Duration
+	}{
+		{cKINDHEARTBEAT, 24 * time.Hour},
+		{cKINDGRAPH, 0},
+		{cKINDINTEGRITY, time.Hour},
+	} {
+		if got := dedupWindow(c.kind); got != c.want {
+			t.Errorf("dedupWindow(%q) = %s, want %s", c.kind, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,542 @@
+// Notification and Dashboard Service for DAM
+//
+// digests: recipients who prefer it get their notifications grouped into one daily or weekly email
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq" // golang postgres db driver
+)
+
+// delivery preferences held in notificationpreference.delivery
+const (
+	cDELIVERYIMMEDIATE = "immediate"
+	cDELIVERYDAILY     = "daily"
+	cDELIVERYWEEKLY    = "weekly"
+)
+
+// notificationqueue.status for a row held back entirely for digests
+const cSTATUSDIGEST = "digest"
+
+// a recipient of a notification: key is the username or address preferences are held under
+type notificationRecipient struct {
+	key     string
+	name    string
+	address string
+	manager bool
+}
+
+// the delivery preference for a recipient, immediate unless they have chosen otherwise.
+func getDeliveryPreference(recipient string) string {
+
+	delivery := cDELIVERYIMMEDIATE
+
+	err := db.QueryRow(`SELECT delivery FROM public.notificationpreference WHERE lower(recipient) = lower($1)`, recipient).Scan(&delivery)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err.Error())
+	}
+
+	return delivery
+}
+
+// splits a notification's recipients into those who get it now, left in msg, and those who get it in a digest.
+// items for managers go out immediately, except to a manager who has chosen a digest; high-priority items always do.
+func holdForDigest(n queuedNotification, msg *outboundMessage, recipients []notificationRecipient) []notificationRecipient {
+
+	held := []notificationRecipient{}
+	immediate := []notificationRecipient{}
+
+	for _, r := range recipients {
+
+		digest := getDeliveryPreference(r.key) != cDELIVERYIMMEDIATE
+		if n.NotifyMgr && !r.manager {
+			digest = false
+		}
+		if n.Severity == cSEVERITYHIGH {
+			digest = false
+		}
+
+		if digest {
+			held = append(held, r)
+		} else {
+			immediate = append(immediate, r)
+		}
+	}
+
+	setRecipients(msg, immediate)
+
+	return held
+}
+
+// queues a notification for each held recipient's next digest.
+func queueDigestItems(n queuedNotification, held []notificationRecipient) bool {
+
+	for _, r := range held {
+
+		_, err := db.Exec(`INSERT INTO public.digestitem
+			(notificationid, recipient, address, delivery, created)
+			VALUES($1, $2, $3, $4, $5)
+			ON CONFLICT (notificationid, recipient) DO NOTHING`, n.ID, r.key, r.address, getDeliveryPreference(r.key), time.Now())
+		if err != nil {
+			if err, ok := err.(*pq.Error); ok {
+				fmt.Println("pq error:", err.Code.Name())
+				logMessage(fmt.Sprintf("Problems queueing digest item [%d] for %s : %s", n.ID, r.key, err.Code.Name()), n.JiraKey, "ERROR")
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// a notification waiting in a digest
+type digestItem struct {
+	id        int
+	address   string
+	jirakey   string
+	asset     string
+	message   string
+	created   time.Time
+	notifyid  int
+	delivered map[string]bool // channels an earlier digest already took it on
+}
+
+// sends each recipient on the given schedule one email with everything waiting for them.
+func doDigest(ctx context.Context, delivery string) (string, error) {
+
+	log.Println("DAMInform.doDigest() " + delivery + " ....")
+
+	query := `SELECT d.id, d.recipient, d.address, q.jirakey, q.asset, q.message, q.created, q.id,
+			coalesce((select array_agg(channel) from public.digestdelivery where digestitemid = d.id), '{}')
+		FROM public.digestitem d
+		INNER JOIN public.notificationqueue q on q.id = d.notificationid
+		WHERE d.sent is null and d.delivery = $1
+		ORDER BY d.recipient, q.jirakey, q.asset, q.created`
+
+	rows, err := db.Query(query, delivery)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems querying digest items : %s", err.Code.Name()), "", "ERROR")
+		}
+		return "", err
+	}
+
+	byrecipient := make(map[string][]digestItem)
+
+	for rows.Next() {
+		item := digestItem{delivered: make(map[string]bool)}
+		recipient := ""
+		var created pq.NullTime
+		delivered := []string{}
+
+		err = rows.Scan(
+			&item.id,
+			&recipient,
+			&item.address,
+			&item.jirakey,
+			&item.asset,
+			&item.message,
+			&created,
+			&item.notifyid,
+			pq.Array(&delivered),
+		)
+
+		if err != nil {
+			logMessage("Problems scanning digestitem"+err.Error(), "", "ERROR")
+			continue
+		}
+
+		item.created = created.Time
+		for _, channel := range delivered {
+			item.delivered[channel] = true
+		}
+		byrecipient[recipient] = append(byrecipient[recipient], item)
+	}
+	rows.Close()
+
+	channels := sessionConfig.DefaultChannels
+	if len(channels) == 0 {
+		channels = []string{cCHANNELSMTP}
+	}
+
+	sent := 0
+	failures := []string{}
+
+	for recipient, items := range byrecipient {
+
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		// each channel gets the items it has not taken yet, so a retry after a partial failure
+		// doesn't repeat the digest on the channels that worked
+		failed := false
+		for _, channel := range channels {
+			notifier, ok := notifiers[channel]
+			if !ok {
+				continue
+			}
+			pending := []digestItem{}
+			for _, item := range items {
+				if !item.delivered[channel] {
+					pending = append(pending, item)
+				}
+			}
+			if len(pending) == 0 {
+				continue
+			}
+			if err := notifier.Notify(composeDigest(delivery, recipient, pending)); err != nil {
+				failures = append(failures, recipient+" via "+channel+": "+err.Error())
+				failed = true
+				continue
+			}
+			recordDigestDelivery(pending, channel)
+		}
+
+		if failed {
+			logMessage("Problems sending "+delivery+" digest to "+recipient, "", "ERROR")
+			continue
+		}
+
+		markDigestSent(items)
+		sent++
+	}
+
+	if len(failures) > 0 {
+		return "", errors.New(strings.Join(failures, "; "))
+	}
+
+	return fmt.Sprintf("%d digests sent", sent), nil
+}
+
+func recordDigestDelivery(items []digestItem, channel string) {
+
+	for _, item := range items {
+		_, err := db.Exec(`INSERT INTO public.digestdelivery
+			(digestitemid, channel, sent)
+			VALUES($1, $2, $3)
+			ON CONFLICT DO NOTHING`, item.id, channel, time.Now())
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems recording digest delivery of [%d] via %s : %s", item.id, channel, err.Code.Name()), item.jirakey, "ERROR")
+		}
+	}
+}
+
+// one email listing a recipient's items, grouped by ticket then asset.
+func composeDigest(delivery, recipient string, items []digestItem) outboundMessage {
+
+	byticket := make(map[string]map[string][]digestItem)
+	for _, item := range items {
+		if _, ok := byticket[item.jirakey]; !ok {
+			byticket[item.jirakey] = make(map[string][]digestItem)
+		}
+		byticket[item.jirakey][item.asset] = append(byticket[item.jirakey][item.asset], item)
+	}
+
+	tickets := []string{}
+	for jirakey := range byticket {
+		tickets = append(tickets, jirakey)
+	}
+	sort.Strings(tickets)
+
+	body := fmt.Sprintf("<h2>DAM %s digest - %d notifications</h2>", delivery, len(items))
+
+	for _, jirakey := range tickets {
+
+		title := jirakey
+		if title == "" {
+			title = "General"
+		}
+		body += fmt.Sprintf("<h3>%s</h3>", html.EscapeString(title))
+
+		assets := []string{}
+		for asset := range byticket[jirakey] {
+			assets = append(assets, asset)
+		}
+		sort.Strings(assets)
+
+		for _, asset := range assets {
+			if asset != "" {
+				body += fmt.Sprintf("<h4>%s</h4>", html.EscapeString(assetDisplayName(asset)))
+			}
+			body += "<ul>"
+			for _, item := range byticket[jirakey][asset] {
+				body += fmt.Sprintf("<li>%s - %s</li>", item.created.Format("2006-01-02 15:04"), item.message)
+			}
+			body += "</ul>"
+		}
+	}
+
+	msg := outboundMessage{
+		To:      []string{items[0].address},
+		Subject: sessionConfig.SubjectPrefix + "DAM: " + delivery + " digest",
+		HTML:    body,
+		Text:    htmlToText(body),
+		Created: time.Now(),
+	}
+
+	view := notificationView{
+		Kind:          cKINDDIGEST,
+		Created:       msg.Created,
+		Message:       htmltemplate.HTML(body),
+		MessageText:   msg.Text,
+		Link:          strings.TrimSuffix(sessionConfig.BaseURL, "/") + "/Notifications",
+		BaseURL:       strings.TrimSuffix(sessionConfig.BaseURL, "/"),
+		SubjectPrefix: sessionConfig.SubjectPrefix,
+		Delivery:      delivery,
+		DeliveryLink:  deliveryLink(recipient),
+	}
+
+	if subject, html, text, ok := renderEmail(cKINDDIGEST, view); ok {
+		msg.Subject = subject
+		msg.HTML = html
+		msg.Text = text
+		msg.Inline = []string{cLOGOPATH}
+	}
+
+	return msg
+}
+
+// marks the items as sent, and any notification with nothing left waiting as sent too.
+func markDigestSent(items []digestItem) {
+
+	for _, item := range items {
+
+		_, err := db.Exec(`UPDATE public.digestitem SET sent = $1 WHERE id = $2`, time.Now(), item.id)
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems updating digest item [%d] : %s", item.id, err.Code.Name()), item.jirakey, "ERROR")
+			continue
+		}
+
+		_, err = db.Exec(`UPDATE public.notificationqueue
+			SET status = $1, sent = $2
+			WHERE id = $3 and status = $4
+			  and not exists (select 1 from public.digestitem where notificationid = $3 and sent is null)`,
+			cSTATUSSENT, time.Now(), item.notifyid, cSTATUSDIGEST)
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems updating notification [%d] : %s", item.notifyid, err.Code.Name()), item.jirakey, "ERROR")
+		}
+	}
+}
+
+// sets how a recipient (username or email address) wants to receive notifications.
+func setDeliveryPreference(recipient, delivery string) bool {
+
+	switch delivery {
+	case cDELIVERYIMMEDIATE, cDELIVERYDAILY, cDELIVERYWEEKLY:
+	default:
+		return false
+	}
+
+	_, err := db.Exec(`INSERT INTO public.notificationpreference
+		(recipient, delivery)
+		VALUES($1, $2)
+		ON CONFLICT (recipient) DO UPDATE SET delivery = excluded.delivery`, strings.ToLower(recipient), delivery)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems saving delivery preference for %s : %s", recipient, err.Code.Name()), "", "ERROR")
+		}
+		return false
+	}
+
+	logMessage("Delivery preference for "+recipient+" set to "+delivery, "", "INFO")
+
+	return true
+}
+
+func deliverySignature(recipient string) string {
+
+	mac := hmac.New(sha256.New, ackSecret)
+	mac.Write([]byte("delivery:" + strings.ToLower(recipient)))
+
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// the link a digest carries, for its recipient to change their own delivery preference.
+func deliveryLink(recipient string) string {
+	return fmt.Sprintf("%s/Delivery,%s,%s", strings.TrimSuffix(sessionConfig.BaseURL, "/"), url.PathEscape(recipient), deliverySignature(recipient))
+}
+
+// /Delivery lists every recipient's preference; /Delivery,<recipient>,<signature> is the page behind a digest's link,
+// for that recipient only. either changes a preference when delivery= is POSTed to it, the list only with the admin
+// token. GET never changes anything, so that mail scanners following links don't.
+func handleDelivery(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(strings.Trim(r.URL.Path, "/"), ",")
+
+	recipient := ""
+	if len(params) > 1 {
+		recipient = strings.Trim(params[1], "/")
+	}
+
+	signature := ""
+	if len(params) > 2 {
+		signature = strings.Trim(params[2], "/")
+		if !hmac.Equal([]byte(signature), []byte(deliverySignature(recipient))) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "this delivery link is not valid")
+			return
+		}
+	}
+
+	// forms post back to the page they are on, carrying the admin token it was opened with
+	formaction := environmentPath("/Delivery")
+	query := ""
+	if token := r.URL.Query().Get("token"); token != "" {
+		query = "?token=" + url.QueryEscape(token)
+	}
+	if signature != "" {
+		formaction = environmentPath("/Delivery," + recipient + "," + signature)
+	}
+
+	switch r.Method {
+	case "GET":
+		report := ""
+		if signature != "" {
+			getDeliveryPage(&report, recipient, formaction)
+		} else if !getDeliveryPreferences(&report, query) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, report)
+
+	case "POST":
+		if signature == "" {
+			recipient = firstOf(r.FormValue("recipient"), recipient)
+			if !isAdmin(r) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		if recipient == "" || !setDeliveryPreference(recipient, strings.ToLower(r.FormValue("delivery"))) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, formaction+query, http.StatusSeeOther)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// the page behind a digest's link: the recipient's preference, with a button for each other choice.
+func getDeliveryPage(report *string, recipient, formaction string) {
+
+	delivery := getDeliveryPreference(recipient)
+
+	page := "<html><body style='font-family: Lato, Arial, sans-serif; color: #333;'>"
+	page += fmt.Sprintf("<h3>DAM notifications for %s</h3><p>You get them %s.</p>", html.EscapeString(recipient), formatDelivery(delivery))
+	page += fmt.Sprintf(`<form method="post" action="%s">`, html.EscapeString(formaction))
+	for _, option := range []string{cDELIVERYIMMEDIATE, cDELIVERYDAILY, cDELIVERYWEEKLY} {
+		if option != delivery {
+			page += fmt.Sprintf(`<button type="submit" name="delivery" value="%s">Get them %s</button> `, option, formatDelivery(option))
+		}
+	}
+	page += "</form></body></html>"
+
+	*report += page
+}
+
+// e.g. "in a daily digest"
+func formatDelivery(delivery string) string {
+
+	if delivery == cDELIVERYIMMEDIATE {
+		return "as they happen"
+	}
+
+	return "in a " + delivery + " digest"
+}
+
+// lists the recipients who have chosen a delivery preference, with what is waiting in their digests.
+// formquery goes on the forms' action, to carry the admin token the page was opened with.
+func getDeliveryPreferences(report *string, formquery string) bool {
+
+	query := `SELECT p.recipient, p.delivery,
+			(select count(*) from public.digestitem d where lower(d.recipient) = p.recipient and d.sent is null)
+		FROM public.notificationpreference p
+		ORDER BY p.recipient`
+
+	tabledef := ""
+	tableheader := ""
+	tablebody := ""
+
+	log.Println("DAMInform.getDeliveryPreferences() ....")
+	tableheader += "<h1>Notification delivery</h1><thead><tr>"
+	tableheader += "<th>Recipient</th><th>Delivery</th><th>Waiting in digest</th><th>Change to</th>"
+	tableheader += "</tr></thead>"
+	tablebody += "<tbody>"
+
+	rows, err := db.Query(query)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		recipient := ""
+		delivery := ""
+		waiting := 0
+
+		err = rows.Scan(
+			&recipient,
+			&delivery,
+			&waiting,
+		)
+
+		if err != nil {
+			log.Println(err.Error())
+			return false
+		}
+
+		tablebody += "<tr>"
+		tablebody += fmt.Sprintf("<th class='row-header'>%s</th>", recipient)
+		tablebody += fmt.Sprintf("<td>%s</td>", delivery)
+		tablebody += fmt.Sprintf("<td>%d</td>", waiting)
+		tablebody += fmt.Sprintf(`<td><form method="post" action="%s"><input type="hidden" name="recipient" value="%s">`,
+			html.EscapeString(environmentPath("/Delivery")+formquery), html.EscapeString(recipient))
+		for _, option := range []string{cDELIVERYIMMEDIATE, cDELIVERYDAILY, cDELIVERYWEEKLY} {
+			if option != delivery {
+				tablebody += fmt.Sprintf(`<button type="submit" name="delivery" value="%s">%s</button> `, option, option)
+			}
+		}
+		tablebody += "</form></td>"
+		tablebody += "</tr>"
+	}
+
+	tablebody += "</tbody>"
+
+	tabledef = tableheader + tablebody
+
+	overlaptemplate, _ := readlines2("html/reporttemplate.html")
+
+	var line string
+	for i := range overlaptemplate {
+		line = overlaptemplate[i]
+		line = strings.Replace(line, "<cdata>%%TABLE%%</cdata>", tabledef, -1)
+		*report += line
+	}
+
+	return true
+}
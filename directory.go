@@ -0,0 +1,298 @@
+// Notification and Dashboard Service for DAM
+//
+// recipient directory: maps usernames to names and addresses, and group names to their members
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3" // ldap directory lookups
+)
+
+// external directory types understood in config.Directory.Type
+const (
+	cDIRECTORYLDAP = "ldap"
+	cDIRECTORYFILE = "file"
+)
+
+// the group whose members are cc'd when notifymgr is set; ManagersEmail is used when it has no members
+const cGROUPMANAGERS = "managers"
+
+// how long an external directory answer is trusted before asking again
+const cDIRECTORYCACHETTL = 15 * time.Minute
+
+// a person notifications can be sent to
+type directoryEntry struct {
+	Username    string
+	DisplayName string
+	Email       string
+}
+
+// where users not in the recipient table are looked up, as declared in config.json
+type directoryConfig struct {
+	Type          string // ldap, file, or empty for the recipient table alone
+	URL           string // ldap: e.g. ldaps://ad.ahs.ca:636
+	BindDN        string
+	BindPassword  string
+	BaseDN        string
+	UserFilter    string // ldap: %s is replaced by the username, e.g. (sAMAccountName=%s)
+	NameAttribute string // ldap: defaults to displayName
+	MailAttribute string // ldap: defaults to mail
+	Path          string // file: json map of username -> {DisplayName, Email}, a stand-in for ldap
+}
+
+// a source of users beyond the recipient table
+type externalDirectory interface {
+	lookupUser(username string) (directoryEntry, bool, error)
+}
+
+var directory externalDirectory
+
+var directoryCache = struct {
+	sync.Mutex
+	entries map[string]cachedEntry
+}{entries: make(map[string]cachedEntry)}
+
+type cachedEntry struct {
+	entry   directoryEntry
+	found   bool
+	fetched time.Time
+}
+
+// sets up the external directory, if one is configured.
+func initDirectory() {
+
+	switch strings.ToLower(sessionConfig.Directory.Type) {
+	case "":
+	case cDIRECTORYLDAP:
+		directory = &ldapDirectory{config: sessionConfig.Directory}
+	case cDIRECTORYFILE:
+		directory = &fileDirectory{path: sessionConfig.Directory.Path}
+	default:
+		logMessage("Directory: unknown directory type "+sessionConfig.Directory.Type, "", "ERROR")
+	}
+}
+
+// finds a user in the recipient table, then in the external directory.
+func lookupUser(username string) (directoryEntry, bool) {
+
+	entry := directoryEntry{Username: username}
+
+	err := db.QueryRow(`SELECT displayname, email FROM public.recipient
+		WHERE lower(username) = lower($1) and active`, username).Scan(&entry.DisplayName, &entry.Email)
+	if err == nil {
+		return entry, true
+	}
+	if err != sql.ErrNoRows {
+		log.Println(err.Error())
+	}
+
+	if directory == nil {
+		return entry, false
+	}
+
+	key := strings.ToLower(username)
+
+	directoryCache.Lock()
+	cached, ok := directoryCache.entries[key]
+	directoryCache.Unlock()
+	if ok && time.Since(cached.fetched) < cDIRECTORYCACHETTL {
+		return cached.entry, cached.found
+	}
+
+	entry, found, err := directory.lookupUser(username)
+	if err != nil {
+		logMessage("Directory: problems looking up "+username+" : "+err.Error(), "", "ERROR")
+		return entry, false
+	}
+
+	directoryCache.Lock()
+	directoryCache.entries[key] = cachedEntry{entry: entry, found: found, fetched: time.Now()}
+	directoryCache.Unlock()
+
+	return entry, found
+}
+
+// the usernames in a group; none if there is no such group.
+func getGroupMembers(group string) []string {
+
+	members := []string{}
+
+	rows, err := db.Query(`SELECT username FROM public.recipientgroup
+		WHERE lower(groupname) = lower($1) ORDER BY username`, group)
+	if err != nil {
+		log.Println(err.Error())
+		return members
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		username := ""
+		if err = rows.Scan(&username); err == nil {
+			members = append(members, username)
+		}
+	}
+
+	return members
+}
+
+// turns a username or group name into recipients. unknown users are logged and replaced
+// by config.FallbackEmail, so their notifications are seen rather than bounced.
+func resolveRecipients(name string, manager bool) []notificationRecipient {
+
+	recipients := []notificationRecipient{}
+
+	usernames := getGroupMembers(name)
+	if len(usernames) == 0 {
+		usernames = []string{name}
+	}
+
+	for _, username := range usernames {
+
+		entry, found := lookupUser(username)
+		if !found || entry.Email == "" {
+			logMessage("Directory: unknown recipient "+username+", sending to fallback address "+sessionConfig.FallbackEmail, "", "ERROR")
+			if sessionConfig.FallbackEmail == "" {
+				continue
+			}
+			entry = directoryEntry{Username: username, DisplayName: username, Email: sessionConfig.FallbackEmail}
+		}
+
+		recipients = append(recipients, notificationRecipient{
+			key:     entry.Username,
+			name:    entry.DisplayName,
+			address: formatRecipient(entry),
+			manager: manager,
+		})
+	}
+
+	return recipients
+}
+
+// the managers to cc: the members of the managers group, or the ManagersEmail list when the group is empty.
+func resolveManagers() []notificationRecipient {
+
+	if len(getGroupMembers(cGROUPMANAGERS)) > 0 {
+		return resolveRecipients(cGROUPMANAGERS, true)
+	}
+
+	recipients := []notificationRecipient{}
+	for _, email := range strings.Split(sessionConfig.ManagersEmail, ",") {
+		email = strings.TrimSpace(email)
+		if email != "" {
+			recipients = append(recipients, notificationRecipient{key: email, name: email, address: email, manager: true})
+		}
+	}
+
+	return recipients
+}
+
+func formatRecipient(entry directoryEntry) string {
+
+	if entry.DisplayName == "" {
+		return entry.Email
+	}
+
+	address := mail.Address{Name: entry.DisplayName, Address: entry.Email}
+	return address.String()
+}
+
+// ---------------------------------------------------------------- ldap
+
+type ldapDirectory struct {
+	config directoryConfig
+}
+
+func (d *ldapDirectory) lookupUser(username string) (directoryEntry, bool, error) {
+
+	entry := directoryEntry{Username: username}
+
+	conn, err := ldap.DialURL(d.config.URL)
+	if err != nil {
+		return entry, false, err
+	}
+	defer conn.Close()
+
+	if d.config.BindDN != "" {
+		if err = conn.Bind(d.config.BindDN, d.config.BindPassword); err != nil {
+			return entry, false, err
+		}
+	}
+
+	filter := d.config.UserFilter
+	if filter == "" {
+		filter = "(sAMAccountName=%s)"
+	}
+	nameattr := d.config.NameAttribute
+	if nameattr == "" {
+		nameattr = "displayName"
+	}
+	mailattr := d.config.MailAttribute
+	if mailattr == "" {
+		mailattr = "mail"
+	}
+
+	request := ldap.NewSearchRequest(
+		d.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 1, 30, false,
+		fmt.Sprintf(filter, ldap.EscapeFilter(username)),
+		[]string{nameattr, mailattr},
+		nil,
+	)
+
+	result, err := conn.Search(request)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return entry, false, fmt.Errorf("%s matches more than one directory entry", username)
+		}
+		return entry, false, err
+	}
+	if len(result.Entries) == 0 {
+		return entry, false, nil
+	}
+
+	entry.DisplayName = result.Entries[0].GetAttributeValue(nameattr)
+	entry.Email = result.Entries[0].GetAttributeValue(mailattr)
+
+	return entry, entry.Email != "", nil
+}
+
+// ---------------------------------------------------------------- file
+
+// a json file standing in for ldap, for development and environments without directory access.
+type fileDirectory struct {
+	path string
+}
+
+func (d *fileDirectory) lookupUser(username string) (directoryEntry, bool, error) {
+
+	entry := directoryEntry{Username: username}
+
+	content, err := os.ReadFile(d.path)
+	if err != nil {
+		return entry, false, err
+	}
+
+	users := make(map[string]directoryEntry)
+	if err = json.Unmarshal(content, &users); err != nil {
+		return entry, false, err
+	}
+
+	for name, user := range users {
+		if strings.EqualFold(name, username) {
+			user.Username = name
+			return user, user.Email != "", nil
+		}
+	}
+
+	return entry, false, nil
+}
@@ -0,0 +1,502 @@
+// Notification and Dashboard Service for DAM
+//
+// notification dispatch: sends notificationqueue rows and tracks delivery per row
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq" // golang postgres db driver
+)
+
+// delivery states held in notificationqueue.status
+const (
+	cSTATUSPENDING   = "pending"
+	cSTATUSSENDING   = "sending"
+	cSTATUSSENT      = "sent"
+	cSTATUSFAILED    = "failed"
+	cSTATUSABANDONED = "abandoned"
+)
+
+// returned by sendNotification when every recipient takes the notification in a digest
+var errHeldForDigest = errors.New("held for digest")
+
+// returned by sendNotification when no recipient resolves, e.g. an unknown lead with no FallbackEmail;
+// the row fails and is retried until it is abandoned, rather than waiting on a digest that never comes
+var errNoRecipients = errors.New("no recipients resolved")
+
+// returned by sendNotification when every recipient was told of the same thing within its dedup window
+var errSuppressed = errors.New("duplicate")
+
+// upper bound on the wait between retries, however many attempts have been made
+const cMAXRETRYBACKOFF = 24 * time.Hour
+
+// a notificationqueue row awaiting delivery
+type queuedNotification struct {
+	ID        int       `json:"id"`
+	Lead      string    `json:"lead"`
+	Message   string    `json:"message"`
+	Asset     string    `json:"asset"`
+	Created   time.Time `json:"created"`
+	NotifyMgr bool      `json:"notifymgr"`
+	JiraKey   string    `json:"jirakey"`
+	Attempts  int       `json:"attempts"`
+	Kind      string    `json:"kind"`
+	Severity  string    `json:"severity"`            // from the status of its ticket, see severity.go
+	Escalates int       `json:"escalates,omitempty"` // escalations: the notification left unacknowledged
+
+	Repeats      int       `json:"repeats,omitempty"`      // duplicates of this one seen since RepeatsSince, itself included
+	RepeatsSince time.Time `json:"repeatssince,omitempty"` // when the last of its duplicates went out
+}
+
+// sends every notification that is due, each row succeeding or failing on its own.
+// returns false if any notification could not be sent.
+func doDispatch() bool {
+
+	log.Println("DAMInform.doDispatch() ....")
+
+	// a previous run that died mid-send leaves rows in 'sending'; put them back in line.
+	// runs never overlap, even across instances (see lockJob), so no live run owns them
+	_, err := db.Exec(`UPDATE public.notificationqueue
+		SET status = $1, lasterror = 'interrupted while sending'
+		WHERE status = $2`, cSTATUSFAILED, cSTATUSSENDING)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems resetting interrupted notifications : %s", err.Code.Name()), "", "ERROR")
+		}
+		return false
+	}
+
+	pending, ok := getDueNotifications(time.Now())
+	if !ok {
+		return false
+	}
+
+	result := true
+
+	for _, n := range pending {
+
+		claimed, ok := markNotificationSending(&n)
+		if !ok {
+			result = false
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		err := sendNotification(n)
+		if err == errSuppressed {
+			markNotificationSuppressed(n)
+			continue
+		}
+		if err == errHeldForDigest {
+			markNotificationDigest(n)
+			continue
+		}
+		if err != nil {
+			logMessage(fmt.Sprintf("Problems sending notification [%d] : %s", n.ID, err.Error()), n.JiraKey, "ERROR")
+			markNotificationFailed(n, err)
+			result = false
+			continue
+		}
+
+		markNotificationSent(n)
+	}
+
+	return result
+}
+
+// reads the rows that are pending, or failed and due for a retry by asof, oldest first.
+func getDueNotifications(asof time.Time) ([]queuedNotification, bool) {
+
+	query := `SELECT id, "lead", message, asset, created, notifymgr, jirakey, attempts, kind, coalesce(escalates, 0)
+			from public.notificationqueue
+			where status = $1
+			   or (status = $2 and (nextattempt is null or nextattempt <= $3))
+			order by id asc`
+
+	rows, err := db.Query(query, cSTATUSPENDING, cSTATUSFAILED, asof)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems querying notifications : %s", err.Code.Name()), "", "ERROR")
+		}
+		return nil, false
+	}
+	defer rows.Close()
+
+	pending := []queuedNotification{}
+
+	for rows.Next() {
+		n := queuedNotification{}
+		var whencreated pq.NullTime
+
+		err = rows.Scan(
+			&n.ID,
+			&n.Lead,
+			&n.Message,
+			&n.Asset,
+			&whencreated,
+			&n.NotifyMgr,
+			&n.JiraKey,
+			&n.Attempts,
+			&n.Kind,
+			&n.Escalates,
+		)
+
+		if err != nil {
+			logMessage("Problems scanning notificationqueue"+err.Error(), "", "ERROR")
+			continue
+		}
+
+		n.Created = whencreated.Time
+		pending = append(pending, n)
+	}
+	rows.Close()
+
+	for i := range pending {
+		pending[i].Severity = notificationSeverity(pending[i])
+	}
+
+	return pending, true
+}
+
+// who a notification is for: the lead (a user or a group) and its subscribers, and the managers when asked to
+// or when it is high priority. a resolved notification goes to the one address that was told of the problem.
+func notificationRecipients(n queuedNotification) []notificationRecipient {
+
+	if n.Kind == cKINDRESOLVED {
+		return []notificationRecipient{{key: n.Lead, name: n.Lead, address: n.Lead}}
+	}
+
+	recipients := resolveRecipients(n.Lead, false)
+	recipients = append(recipients, resolveSubscribers(n)...)
+	if n.NotifyMgr || n.Severity == cSEVERITYHIGH {
+		recipients = append(recipients, resolveManagers()...)
+	}
+
+	return recipients
+}
+
+// composes the message for a notification to its recipients from the template for its kind.
+func composeNotification(n queuedNotification, recipients []notificationRecipient) outboundMessage {
+
+	msg := outboundMessage{
+		NotificationID: n.ID,
+		Subject:        sessionConfig.SubjectPrefix + "DAM: " + n.JiraKey,
+		HTML:           n.Message,
+		Text:           htmlToText(n.Message),
+		JiraKey:        n.JiraKey,
+		Asset:          n.Asset,
+		Lead:           n.Lead,
+		NotifyMgr:      n.NotifyMgr,
+		Created:        n.Created,
+		Severity:       n.Severity,
+	}
+
+	setRecipients(&msg, recipients)
+
+	view := newNotificationView(n)
+	addWhereUsed(n, &view, &msg)
+
+	if subject, html, text, ok := renderEmail(n.Kind, view); ok {
+		msg.Subject = subject
+		msg.HTML = html
+		msg.Text = text
+		msg.Inline = []string{cLOGOPATH}
+	}
+
+	if n.Severity == cSEVERITYHIGH {
+		msg.Subject = sessionConfig.HighPrioritySubjectTag + msg.Subject
+	}
+
+	return msg
+}
+
+// addresses the message: managers on Cc, everyone else on To, nobody twice.
+func setRecipients(msg *outboundMessage, recipients []notificationRecipient) {
+
+	msg.To = []string{}
+	msg.Cc = []string{}
+	seen := make(map[string]bool)
+
+	for _, r := range recipients {
+		if seen[strings.ToLower(r.address)] {
+			continue
+		}
+		seen[strings.ToLower(r.address)] = true
+
+		if r.manager {
+			msg.Cc = append(msg.Cc, r.address)
+		} else {
+			msg.To = append(msg.To, r.address)
+		}
+	}
+}
+
+// what dispatch will do with a notification: the message, who waits for a digest, and the
+// channels it still has to go out on. working it out changes nothing, so previews use it too.
+type dispatchPlan struct {
+	Notification queuedNotification `json:"notification"`
+	Message      outboundMessage    `json:"message"`
+	Digest       []string           `json:"digest"`     // recipients who get it in their next digest
+	Channels     []string           `json:"channels"`   // channels it will be sent on now
+	Delivered    []string           `json:"delivered"`  // channels an earlier attempt already sent it on
+	Duplicates   []string           `json:"duplicates"` // recipients already told inside its dedup window, left out
+	Suppressed   bool               `json:"suppressed"` // every recipient was a duplicate, nothing will be sent
+
+	told       []notificationRecipient
+	duplicates []notificationRecipient
+	held       []notificationRecipient
+}
+
+func planNotification(n queuedNotification) dispatchPlan {
+
+	plan := dispatchPlan{
+		Digest:     []string{},
+		Channels:   []string{},
+		Delivered:  []string{},
+		Duplicates: []string{},
+	}
+
+	recipients, duplicates := filterDuplicates(&n, notificationRecipients(n))
+	plan.Notification = n
+	plan.told = recipients
+	plan.duplicates = duplicates
+	for _, r := range duplicates {
+		plan.Duplicates = append(plan.Duplicates, r.address)
+	}
+	if len(recipients) == 0 && len(duplicates) > 0 {
+		plan.Suppressed = true
+		return plan
+	}
+
+	msg := composeNotification(n, recipients)
+
+	plan.held = holdForDigest(n, &msg, recipients)
+	for _, r := range plan.held {
+		plan.Digest = append(plan.Digest, r.address)
+	}
+	plan.Message = msg
+
+	if len(msg.To) == 0 && len(msg.Cc) == 0 {
+		return plan
+	}
+
+	channels := routeNotification(n)
+	if n.Severity == cSEVERITYHIGH {
+		channels = addHighPriorityChannels(channels)
+	}
+
+	delivered := getDeliveredChannels(n.ID)
+	for _, channel := range channels {
+		if delivered[channel] {
+			plan.Delivered = append(plan.Delivered, channel)
+		} else {
+			plan.Channels = append(plan.Channels, channel)
+		}
+	}
+
+	return plan
+}
+
+// sends a notification on each channel its routes pick, to the recipients who want it now.
+// channels that already took it on an earlier attempt are skipped, so a retry only repeats the ones that failed.
+func sendNotification(n queuedNotification) error {
+
+	plan := planNotification(n)
+	msg := plan.Message
+
+	if plan.Suppressed {
+		countDuplicates(n, plan.duplicates)
+		return errSuppressed
+	}
+
+	if !queueDigestItems(n, plan.held) {
+		return errors.New("unable to queue digest items")
+	}
+	if len(msg.To) == 0 && len(msg.Cc) == 0 {
+		if len(plan.held) > 0 {
+			countDuplicates(n, plan.duplicates)
+			recordNotified(n, plan.told)
+			return errHeldForDigest
+		}
+		return errNoRecipients
+	}
+
+	failures := []string{}
+
+	for _, email := range msg.Cc {
+		logMessage("Notifying manager : "+email, "", "DEBUG")
+	}
+
+	for _, channel := range plan.Channels {
+
+		notifier, ok := notifiers[channel]
+		if !ok {
+			failures = append(failures, channel+": no such channel")
+			continue
+		}
+
+		logMessage(fmt.Sprintf("Sending notification about %s via %s to %s : %s", n.JiraKey, channel, strings.Join(msg.To, ","), n.Message), n.JiraKey, "DEBUG")
+
+		if err := notifier.Notify(msg); err != nil {
+			failures = append(failures, channel+": "+err.Error())
+			continue
+		}
+
+		recordDelivery(n, channel)
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+
+	countDuplicates(n, plan.duplicates)
+	recordNotified(n, plan.told)
+
+	return nil
+}
+
+// the channels a notification has already gone out on.
+func getDeliveredChannels(id int) map[string]bool {
+
+	delivered := make(map[string]bool)
+
+	rows, err := db.Query(`SELECT channel FROM public.notificationdelivery WHERE notificationid = $1`, id)
+	if err != nil {
+		log.Println(err.Error())
+		return delivered
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		channel := ""
+		if err = rows.Scan(&channel); err == nil {
+			delivered[channel] = true
+		}
+	}
+
+	return delivered
+}
+
+func recordDelivery(n queuedNotification, channel string) {
+
+	_, err := db.Exec(`INSERT INTO public.notificationdelivery
+		(notificationid, channel, sent)
+		VALUES($1, $2, $3)
+		ON CONFLICT DO NOTHING`, n.ID, channel, time.Now())
+	if err, ok := err.(*pq.Error); ok {
+		fmt.Println("pq error:", err.Code.Name())
+		logMessage(fmt.Sprintf("Problems recording delivery of [%d] via %s : %s", n.ID, channel, err.Code.Name()), n.JiraKey, "ERROR")
+	}
+}
+
+// claims a row for sending and counts the attempt. claimed is false when the row is no longer
+// pending or failed, i.e. someone else has dealt with it since it was read.
+func markNotificationSending(n *queuedNotification) (claimed bool, ok bool) {
+
+	err := db.QueryRow(`UPDATE public.notificationqueue
+		SET status = $1, attempts = attempts + 1, severity = $2
+		WHERE id = $3 and status in ($4, $5)
+		RETURNING attempts`, cSTATUSSENDING, n.Severity, n.ID, cSTATUSPENDING, cSTATUSFAILED).Scan(&n.Attempts)
+	if err == sql.ErrNoRows {
+		return false, true
+	}
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems updating notification [%d] : %s", n.ID, err.Code.Name()), n.JiraKey, "ERROR")
+		}
+		return false, false
+	}
+
+	return true, true
+}
+
+func markNotificationSent(n queuedNotification) {
+
+	_, err := db.Exec(`UPDATE public.notificationqueue
+		SET status = $1, sent = $2, lasterror = '', nextattempt = null
+		WHERE id = $3`, cSTATUSSENT, time.Now(), n.ID)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems updating notification [%d] : %s", n.ID, err.Code.Name()), n.JiraKey, "ERROR")
+		}
+	}
+}
+
+// a duplicate inside its suppression window: counted, never sent.
+func markNotificationSuppressed(n queuedNotification) {
+
+	_, err := db.Exec(`UPDATE public.notificationqueue
+		SET status = $1, nextattempt = null
+		WHERE id = $2`, cSTATUSSUPPRESSED, n.ID)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems updating notification [%d] : %s", n.ID, err.Code.Name()), n.JiraKey, "ERROR")
+		}
+	}
+}
+
+// the notification now waits only in digests; the digest job marks it sent.
+func markNotificationDigest(n queuedNotification) {
+
+	_, err := db.Exec(`UPDATE public.notificationqueue
+		SET status = $1, lasterror = '', nextattempt = null
+		WHERE id = $2`, cSTATUSDIGEST, n.ID)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems updating notification [%d] : %s", n.ID, err.Code.Name()), n.JiraKey, "ERROR")
+		}
+	}
+}
+
+// records the failure and schedules a retry, or gives up once the attempt limit is reached.
+func markNotificationFailed(n queuedNotification, sendErr error) {
+
+	status := cSTATUSFAILED
+	var nextattempt interface{}
+
+	if n.Attempts >= sessionConfig.MaxDeliveryAttempts {
+		status = cSTATUSABANDONED
+		logMessage(fmt.Sprintf("Abandoning notification [%d] after %d attempts", n.ID, n.Attempts), n.JiraKey, "ERROR")
+	} else {
+		nextattempt = time.Now().Add(retryBackoff(n.Attempts))
+	}
+
+	_, err := db.Exec(`UPDATE public.notificationqueue
+		SET status = $1, lasterror = $2, nextattempt = $3
+		WHERE id = $4`, status, sendErr.Error(), nextattempt, n.ID)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems updating notification [%d] : %s", n.ID, err.Code.Name()), n.JiraKey, "ERROR")
+		}
+	}
+}
+
+// exponential backoff: the base delay doubles with each failed attempt.
+func retryBackoff(attempts int) time.Duration {
+
+	delay := time.Duration(sessionConfig.RetryBackoffSeconds) * time.Second
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= cMAXRETRYBACKOFF {
+			return cMAXRETRYBACKOFF
+		}
+	}
+
+	return delay
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+
+	useConfig(t)
+	sessionConfig.RetryBackoffSeconds = 60
+
+	for _, c := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{5, 16 * time.Minute},
+		{11, 1024 * time.Minute},
+		{12, cMAXRETRYBACKOFF}, // 2048 minutes is over a day
+		{1000, cMAXRETRYBACKOFF},
+	} {
+		if got := retryBackoff(c.attempts); got != c.want {
+			t.Errorf("retryBackoff(%d) = %s, want %s", c.attempts, got, c.want)
+		}
+	}
+}
+
+func TestRetryBackoffNeverExceedsTheCap(t *testing.T) {
+
+	useConfig(t)
+	sessionConfig.RetryBackoffSeconds = 7 * 3600
+
+	previous := time.Duration(0)
+	for attempts := 1; attempts < 100; attempts++ {
+		delay := retryBackoff(attempts)
+		if delay > cMAXRETRYBACKOFF {
+			t.Fatalf("retryBackoff(%d) = %s, over %s", attempts, delay, cMAXRETRYBACKOFF)
+		}
+		if delay < previous {
+			t.Fatalf("retryBackoff(%d) = %s, less than the attempt before", attempts, delay)
+		}
+		previous = delay
+	}
+}
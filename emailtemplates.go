@@ -0,0 +1,182 @@
+// Notification and Dashboard Service for DAM
+//
+// email templates: one html and one plain-text Go template per notification kind, sharing a branded layout
+
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// notificationqueue.kind values with templates of their own; anything else uses cKINDGENERAL
+const (
+	cKINDGENERAL      = "general"
+	cKINDINTEGRITY    = "integrity"
+	cKINDSTALE        = "stale"
+	cKINDLOCKCONFLICT = "lockconflict"
+	cKINDDIGEST       = "digest"
+)
+
+// the logo every html email carries, embedded and referenced as cid:AHS-logo.jpg
+const cLOGOPATH = "html/AHS-logo.jpg"
+
+// what a template can use
+type notificationView struct {
+	Kind          string
+	JiraKey       string
+	Asset         string
+	AssetName     string // asset without the extension of its type
+	Lead          string
+	Created       time.Time
+	Message       htmltemplate.HTML // as queued; producers write html
+	MessageText   string            // the message with the markup taken out
+	Link          string            // the DAMInform page to look at
+	BaseURL       string
+	SubjectPrefix string
+	Delivery      string // digests only: daily or weekly
+	DeliveryLink  string // digests only: where the recipient changes how they get notifications
+	Repeats       int    // times this was seen since RepeatsSince, when duplicates were suppressed
+	RepeatsSince  time.Time
+	AckLink       string // acknowledges the notification, or the one an escalation follows up
+
+	WhereUsedSummary string // e.g. "used by 3 order panels, 12 order sets", with config.AttachWhereUsed
+	WhereUsedLink    string
+}
+
+type emailTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+var emailTemplates = make(map[string]emailTemplate)
+
+// parses <kind>.html and <kind>.txt from config.TemplatePath, each together with _layout.html / _layout.txt.
+func initTemplates() {
+
+	files, err := filepath.Glob(filepath.Join(sessionConfig.TemplatePath, "*.html"))
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	for _, htmlfile := range files {
+
+		kind := strings.TrimSuffix(filepath.Base(htmlfile), ".html")
+		if strings.HasPrefix(kind, "_") {
+			continue
+		}
+
+		textfile := strings.TrimSuffix(htmlfile, ".html") + ".txt"
+		if _, err := os.Stat(textfile); err != nil {
+			logMessage("Templates: "+kind+" has no plain-text template "+textfile, "", "ERROR")
+			continue
+		}
+
+		h, err := htmltemplate.ParseFiles(filepath.Join(sessionConfig.TemplatePath, "_layout.html"), htmlfile)
+		if err != nil {
+			logMessage("Templates: problems parsing "+htmlfile+" : "+err.Error(), "", "ERROR")
+			continue
+		}
+
+		t, err := texttemplate.ParseFiles(filepath.Join(sessionConfig.TemplatePath, "_layout.txt"), textfile)
+		if err != nil {
+			logMessage("Templates: problems parsing "+textfile+" : "+err.Error(), "", "ERROR")
+			continue
+		}
+
+		emailTemplates[kind] = emailTemplate{html: h, text: t}
+	}
+
+	if _, ok := emailTemplates[cKINDGENERAL]; !ok {
+		logMessage("Templates: no "+cKINDGENERAL+" template in "+sessionConfig.TemplatePath+", notifications will go out untemplated", "", "ERROR")
+	}
+
+	log.Printf("DAMInform: %d email templates loaded from %s\n", len(emailTemplates), sessionConfig.TemplatePath)
+}
+
+// the view of a queued notification its template is rendered with.
+func newNotificationView(n queuedNotification) notificationView {
+
+	baseURL := strings.TrimSuffix(sessionConfig.BaseURL, "/")
+
+	link := baseURL + "/Notifications"
+	switch n.Kind {
+	case cKINDINTEGRITY, cKINDTEMPLATECONTENT:
+		// the stored runs, not /IntegrityCheck: following a link must not start a walk of the repository
+		link = baseURL + "/IntegrityHistory"
+	case cKINDHEARTBEAT:
+		link = baseURL + "/Heartbeat"
+	case cKINDGRAPH:
+		// the graphcheck job's last outcome; /GraphCheck would run the check again
+		link = baseURL + "/Jobs"
+	}
+
+	acklink := ""
+	if n.Escalates > 0 {
+		acklink = ackLink(n.Escalates)
+	} else if needsAck(n.Kind) {
+		acklink = ackLink(n.ID)
+	}
+
+	return notificationView{
+		Kind:          n.Kind,
+		JiraKey:       n.JiraKey,
+		Asset:         n.Asset,
+		AssetName:     assetDisplayName(n.Asset),
+		Lead:          n.Lead,
+		Created:       n.Created,
+		Message:       htmltemplate.HTML(n.Message),
+		MessageText:   htmlToText(n.Message),
+		Link:          link,
+		BaseURL:       baseURL,
+		SubjectPrefix: sessionConfig.SubjectPrefix,
+		Repeats:       n.Repeats,
+		RepeatsSince:  n.RepeatsSince,
+		AckLink:       acklink,
+	}
+}
+
+// renders the subject, html and plain-text bodies for a kind of notification.
+// the subject comes from a "subject" block in the text template; without one it is "DAM: <jirakey>".
+func renderEmail(kind string, view notificationView) (subject, html, text string, ok bool) {
+
+	tmpl, found := emailTemplates[kind]
+	if !found {
+		tmpl, found = emailTemplates[cKINDGENERAL]
+	}
+	if !found {
+		return "", "", "", false
+	}
+
+	var buf bytes.Buffer
+
+	if err := tmpl.html.ExecuteTemplate(&buf, "layout", view); err != nil {
+		logMessage("Templates: problems rendering "+kind+" html : "+err.Error(), view.JiraKey, "ERROR")
+		return "", "", "", false
+	}
+	html = buf.String()
+
+	buf.Reset()
+	if err := tmpl.text.ExecuteTemplate(&buf, "layout", view); err != nil {
+		logMessage("Templates: problems rendering "+kind+" text : "+err.Error(), view.JiraKey, "ERROR")
+		return "", "", "", false
+	}
+	text = buf.String()
+
+	subject = "DAM: " + view.JiraKey
+	if tmpl.text.Lookup("subject") != nil {
+		buf.Reset()
+		if err := tmpl.text.ExecuteTemplate(&buf, "subject", view); err == nil {
+			subject = strings.TrimSpace(buf.String())
+		}
+	}
+
+	return sessionConfig.SubjectPrefix + subject, html, text, true
+}
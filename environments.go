@@ -0,0 +1,499 @@
+// Notification and Dashboard Service for DAM
+//
+// environments: one DAMInform serving DEV, TEST and PROD. each configured environment runs as a worker process of
+// this binary, with its own db, ChangesetPath and SubjectPrefix, on a local port; the main process routes every
+// request to the environment it names and shows them side by side on /Dashboard.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the cookie that remembers the environment last asked for, so that links within its pages stay in it
+const cENVIRONMENTCOOKIE = "daminform-env"
+
+// how long a worker that exited waits before it is started again
+const cENVIRONMENTRESTART = 10 * time.Second
+
+// one environment, from config.Environments; empty settings are taken from the top of config.json
+type environmentConfig struct {
+	Name          string // e.g. PROD, as in ?env=PROD
+	DBhost        string
+	DBusr         string
+	DBpw          string // better kept in SecretsFile (EnvironmentDBpw) or DAMINFORM_DBPW_<NAME>
+	DBPort        string
+	DBName        string
+	ChangesetPath string
+	SubjectPrefix string
+	ListenPort    string // the worker's port, on localhost only
+}
+
+// set by -env <name>: this process is the worker for that environment
+var environmentName string
+
+// a worker, as the main process sees it
+type environmentWorker struct {
+	config   environmentConfig
+	proxy    *httputil.ReverseProxy
+	mu       sync.Mutex
+	running  bool
+	restarts int
+	lastexit string
+	db       *sql.DB // for the dashboard, opened when first needed
+}
+
+var environmentWorkers = make(map[string]*environmentWorker)
+
+// the environment called name, from config.
+func findEnvironment(name string) (environmentConfig, bool) {
+
+	for _, e := range sessionConfig.Environments {
+		if strings.EqualFold(e.Name, name) {
+			return e, true
+		}
+	}
+
+	return environmentConfig{}, false
+}
+
+// makes this process the environment's worker: its settings replace those at the top of config.json,
+// and links in emails lead back through the main process to it.
+func useEnvironment(name string) error {
+
+	e, ok := findEnvironment(name)
+	if !ok {
+		return fmt.Errorf("no environment %q in config.json", name)
+	}
+	if e.ListenPort == "" {
+		return fmt.Errorf("environment %s has no ListenPort", e.Name)
+	}
+
+	if sessionConfig.BaseURL == "" {
+		hostname, _ := os.Hostname()
+		sessionConfig.BaseURL = "http://" + hostname + ":" + sessionConfig.ListenPort
+	}
+	sessionConfig.BaseURL = strings.TrimSuffix(sessionConfig.BaseURL, "/") + "/env/" + e.Name
+
+	sessionConfig.DBhost = firstOf(e.DBhost, sessionConfig.DBhost)
+	sessionConfig.DBusr = firstOf(e.DBusr, sessionConfig.DBusr)
+	sessionConfig.DBpw = firstOf(e.DBpw, sessionConfig.DBpw)
+	sessionConfig.DBPort = firstOf(e.DBPort, sessionConfig.DBPort)
+	sessionConfig.DBName = firstOf(e.DBName, sessionConfig.DBName)
+	sessionConfig.ChangesetPath = firstOf(e.ChangesetPath, sessionConfig.ChangesetPath)
+	sessionConfig.SubjectPrefix = firstOf(e.SubjectPrefix, sessionConfig.SubjectPrefix)
+	sessionConfig.ListenPort = e.ListenPort
+
+	environmentName = e.Name
+
+	return nil
+}
+
+// a path on this process as a browser reaches it: through the main process's /env/<name>/ when this is a
+// worker, so that forms and links stay in the environment they came from.
+func environmentPath(path string) string {
+
+	if environmentName == "" {
+		return path
+	}
+
+	return "/env/" + environmentName + path
+}
+
+func firstOf(values ...string) string {
+
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// the main process: starts a worker per environment, keeps them running, and serves config.ListenPort for them all.
+func runEnvironments() {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	executable, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+
+	for _, e := range sessionConfig.Environments {
+
+		if e.ListenPort == "" {
+			panic("environment " + e.Name + " has no ListenPort")
+		}
+
+		target, _ := url.Parse("http://127.0.0.1:" + e.ListenPort)
+		worker := &environmentWorker{config: e, proxy: httputil.NewSingleHostReverseProxy(target)}
+		environmentWorkers[strings.ToUpper(e.Name)] = worker
+
+		go worker.supervise(ctx, executable)
+	}
+
+	http.HandleFunc("/", environmentHandler)
+
+	server := &http.Server{Addr: ":" + sessionConfig.ListenPort}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	log.Println("Listening... (" + sessionConfig.ListenPort + ") for " + fmt.Sprint(len(environmentWorkers)) + " environments")
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Println("ERROR " + err.Error())
+	}
+}
+
+// runs the worker, and runs it again when it exits, until ctx is done.
+func (worker *environmentWorker) supervise(ctx context.Context, executable string) {
+
+	for ctx.Err() == nil {
+
+		cmd := exec.CommandContext(ctx, executable, "-env", worker.config.Name)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		worker.mu.Lock()
+		worker.running = true
+		worker.mu.Unlock()
+
+		err := cmd.Run()
+
+		worker.mu.Lock()
+		worker.running = false
+		worker.lastexit = time.Now().Format("2006-01-02 15:04:05")
+		if err != nil {
+			worker.lastexit += " - " + err.Error()
+		}
+		worker.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("DAMInform: environment %s stopped (%v), starting it again in %s", worker.config.Name, err, cENVIRONMENTRESTART)
+
+		select {
+		case <-time.After(cENVIRONMENTRESTART):
+		case <-ctx.Done():
+			return
+		}
+
+		worker.mu.Lock()
+		worker.restarts++
+		worker.mu.Unlock()
+	}
+}
+
+// the environment a request is for, and its path without any /env/<name> prefix: the prefix,
+// else ?env=, else - for a page that only reads - the environment last asked for, else the first configured.
+// chosen is false when the request named no environment itself.
+func requestEnvironment(r *http.Request) (name, path string, chosen bool) {
+
+	path = r.URL.Path
+
+	if strings.HasPrefix(path, "/env/") {
+		rest := strings.TrimPrefix(path, "/env/")
+		name = rest
+		path = "/"
+		if i := strings.Index(rest, "/"); i >= 0 {
+			name = rest[:i]
+			path = rest[i:]
+		}
+		return name, path, true
+	}
+
+	if name = r.URL.Query().Get("env"); name != "" {
+		return name, path, true
+	}
+
+	if !readOnlyRequest(r) {
+		return "", path, false
+	}
+
+	if cookie, err := r.Cookie(cENVIRONMENTCOOKIE); err == nil && cookie.Value != "" {
+		return cookie.Value, path, false
+	}
+
+	return sessionConfig.Environments[0].Name, path, false
+}
+
+// pages whose GET starts a check, runs a job or changes something: the handler routes on strings.Contains,
+// so a path naming any of these anywhere runs it.
+var environmentActionPages = []string{"Dispatch", "RunJob", "CancelJob", "FixTicket", "IntegrityCheck", "GraphCheck"}
+
+// whether a request only reads, so that it may go to the environment last asked for.
+func readOnlyRequest(r *http.Request) bool {
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	for _, page := range environmentActionPages {
+		if strings.Contains(r.URL.Path, page) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// who sent a request: behind the main process a worker sees every request come from localhost,
+// so there it is the address the proxy added to X-Forwarded-For.
+func clientAddress(r *http.Request) string {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return r.RemoteAddr
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		return r.RemoteAddr
+	}
+
+	// the proxy appends to whatever the client sent, so only the last address is its own
+	addresses := strings.Split(forwarded[len(forwarded)-1], ",")
+	if client := strings.TrimSpace(addresses[len(addresses)-1]); client != "" {
+		return client
+	}
+
+	return r.RemoteAddr
+}
+
+// the main process's handler: /Dashboard itself, everything else passed to the environment's worker.
+func environmentHandler(w http.ResponseWriter, r *http.Request) {
+
+	report := ""
+
+	if r.Method == "GET" && r.URL.Path == "/Dashboard" {
+		if getDashboard(&report) {
+			fmt.Fprint(w, report)
+		}
+		return
+	}
+
+	name, path, chosen := requestEnvironment(r)
+
+	// anything that runs or changes something must say which environment it is for, a cookie from another tab won't do
+	if name == "" {
+		http.Error(w, "name the environment: /env/<name>"+r.URL.Path+" or ?env=<name>", http.StatusBadRequest)
+		return
+	}
+
+	worker, ok := environmentWorkers[strings.ToUpper(name)]
+	if !ok {
+		http.Error(w, fmt.Sprintf("no environment %q", name), http.StatusNotFound)
+		return
+	}
+
+	if chosen {
+		http.SetCookie(w, &http.Cookie{Name: cENVIRONMENTCOOKIE, Value: worker.config.Name, Path: "/"})
+	}
+
+	r.URL.Path = path
+	r.URL.RawPath = ""
+	worker.proxy.ServeHTTP(w, r)
+}
+
+// the environment's db, for the dashboard.
+func (worker *environmentWorker) database() (*sql.DB, error) {
+
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	if worker.db != nil {
+		return worker.db, nil
+	}
+
+	e := worker.config
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		firstOf(e.DBhost, sessionConfig.DBhost), firstOf(e.DBPort, sessionConfig.DBPort), firstOf(e.DBusr, sessionConfig.DBusr),
+		firstOf(e.DBpw, sessionConfig.DBpw), firstOf(e.DBName, sessionConfig.DBName)))
+	if err != nil {
+		return nil, err
+	}
+	worker.db = db
+
+	return db, nil
+}
+
+// what the dashboard shows for one environment
+type environmentStatus struct {
+	Worker      string
+	Integrity   string
+	OpenProblem string
+	Queue       string
+	Heartbeat   string
+	Errors      string
+	LastError   string
+}
+
+func (worker *environmentWorker) status(ctx context.Context) environmentStatus {
+
+	s := environmentStatus{}
+
+	worker.mu.Lock()
+	s.Worker = "running"
+	if !worker.running {
+		s.Worker = "stopped " + worker.lastexit
+	}
+	if worker.restarts > 0 {
+		s.Worker += fmt.Sprintf(", restarted %d times", worker.restarts)
+	}
+	worker.mu.Unlock()
+
+	db, err := worker.database()
+	if err != nil {
+		s.Integrity = err.Error()
+		return s
+	}
+
+	var started time.Time
+	problems := 0
+	complete := false
+	err = db.QueryRowContext(ctx, `SELECT started, problems, complete FROM public.integrityrun ORDER BY started desc LIMIT 1`).Scan(&started, &problems, &complete)
+	switch {
+	case err == sql.ErrNoRows:
+		s.Integrity = "never checked"
+	case err != nil:
+		s.Integrity = "unreachable: " + err.Error()
+		return s
+	case !complete:
+		s.Integrity = fmt.Sprintf("%s, did not complete", started.Format("2006-01-02 15:04"))
+	default:
+		s.Integrity = fmt.Sprintf("%s, %d problems", started.Format("2006-01-02 15:04"), problems)
+	}
+
+	open := 0
+	if err = db.QueryRowContext(ctx, `SELECT count(*) FROM public.integrityproblem WHERE resolved is null`).Scan(&open); err == nil {
+		s.OpenProblem = fmt.Sprint(open)
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT status, count(*) FROM public.notificationqueue
+		WHERE status in ($1, $2, $3, $4) GROUP BY status ORDER BY status`,
+		cSTATUSPENDING, cSTATUSSENDING, cSTATUSFAILED, cSTATUSABANDONED)
+	if err == nil {
+		counts := []string{}
+		for rows.Next() {
+			status := ""
+			count := 0
+			if rows.Scan(&status, &count) == nil {
+				counts = append(counts, fmt.Sprintf("%d %s", count, status))
+			}
+		}
+		rows.Close()
+		s.Queue = "nothing waiting"
+		if len(counts) > 0 {
+			s.Queue = strings.Join(counts, ", ")
+		}
+	}
+
+	folders, passed := 0, 0
+	err = db.QueryRowContext(ctx, `SELECT count(*), count(*) filter (where ok) FROM public.heartbeat
+		WHERE started = (SELECT max(started) FROM public.heartbeat)`).Scan(&folders, &passed)
+	if err == nil && folders > 0 {
+		s.Heartbeat = fmt.Sprintf("%d of %d folders recorded", passed, folders)
+	}
+
+	errors := 0
+	if err = db.QueryRowContext(ctx, `SELECT count(*) FROM public.log
+		WHERE logtype = 'ERROR' and messagetime > $1`, time.Now().Add(-24*time.Hour)).Scan(&errors); err == nil {
+		s.Errors = fmt.Sprint(errors)
+	}
+	db.QueryRowContext(ctx, `SELECT message FROM public.log WHERE logtype = 'ERROR' ORDER BY messagetime desc LIMIT 1`).Scan(&s.LastError)
+
+	return s
+}
+
+// the combined dashboard: integrity, queue and log status of every environment side by side.
+func getDashboard(report *string) bool {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	statuses := make([]environmentStatus, len(sessionConfig.Environments))
+	var wg sync.WaitGroup
+	for i, e := range sessionConfig.Environments {
+		wg.Add(1)
+		go func(i int, worker *environmentWorker) {
+			defer wg.Done()
+			statuses[i] = worker.status(ctx)
+		}(i, environmentWorkers[strings.ToUpper(e.Name)])
+	}
+	wg.Wait()
+
+	tabledef := ""
+	tableheader := ""
+	tablebody := ""
+
+	log.Println("DAMInform.getDashboard() ....")
+
+	tableheader += "<h1>DAMInform environments</h1><thead><tr><th></th>"
+	for _, e := range sessionConfig.Environments {
+		tableheader += fmt.Sprintf("<th>%s</th>", html.EscapeString(e.Name))
+	}
+	tableheader += "</tr></thead>"
+	tablebody += "<tbody>"
+
+	for _, line := range []struct {
+		title string
+		page  string
+		value func(s environmentStatus) string
+	}{
+		{"DAMInform", "Jobs", func(s environmentStatus) string { return s.Worker }},
+		{"Last integrity check", "IntegrityHistory", func(s environmentStatus) string { return s.Integrity }},
+		{"Open integrity problems", "IntegrityHistory", func(s environmentStatus) string { return s.OpenProblem }},
+		{"Notification queue", "Notifications", func(s environmentStatus) string { return s.Queue }},
+		{"DAMLogger heartbeat", "Heartbeat", func(s environmentStatus) string { return s.Heartbeat }},
+		{"Errors logged, last 24 hours", "Log", func(s environmentStatus) string { return s.Errors }},
+		{"Last error", "Log", func(s environmentStatus) string { return s.LastError }},
+	} {
+		tablebody += "<tr>"
+		tablebody += fmt.Sprintf("<th class='row-header'>%s</th>", line.title)
+		for i, e := range sessionConfig.Environments {
+			tablebody += fmt.Sprintf("<td><a href='/env/%s/%s'>%s</a></td>",
+				url.PathEscape(e.Name), line.page, html.EscapeString(line.value(statuses[i])))
+		}
+		tablebody += "</tr>"
+	}
+
+	tablebody += "</tbody>"
+
+	tabledef = tableheader + tablebody
+
+	overlaptemplate, _ := readlines2("html/reporttemplate.html")
+
+	var line string
+	for i := range overlaptemplate {
+		line = overlaptemplate[i]
+		line = strings.Replace(line, "<cdata>%%TABLE%%</cdata>", tabledef, -1)
+		*report += line
+	}
+
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestEnvironment(t *testing.T) {
+
+	useConfig(t)
+	sessionConfig.Environments = []environmentConfig{{Name: "DEV"}, {Name: "TEST"}, {Name: "PROD"}}
+
+	for _, c := range []struct {
+		method string
+		target string
+		cookie string
+		name   string
+		path   string
+		chosen bool
+	}{
+		{"GET", "/env/PROD/Notifications", "", "PROD", "/Notifications", true},
+		{"GET", "/env/PROD", "", "PROD", "/", true},
+		{"POST", "/env/PROD/Repair,CSDFK-1234", "DEV", "PROD", "/Repair,CSDFK-1234", true},
+		{"GET", "/Notifications?env=TEST", "DEV", "TEST", "/Notifications", true},
+		{"GET", "/RunJob,dispatch?env=TEST", "", "TEST", "/RunJob,dispatch", true},
+
+		// pages that only read follow the cookie, then the first environment
+		{"GET", "/Notifications", "TEST", "TEST", "/Notifications", false},
+		{"GET", "/Repair,CSDFK-1234", "TEST", "TEST", "/Repair,CSDFK-1234", false},
+		{"GET", "/IntegrityHistory", "", "DEV", "/IntegrityHistory", false},
+		{"HEAD", "/Jobs", "", "DEV", "/Jobs", false},
+
+		// anything that runs or changes something has to name its environment
+		{"POST", "/Repair,CSDFK-1234", "PROD", "", "/Repair,CSDFK-1234", false},
+		{"DELETE", "/Subscriptions,7", "PROD", "", "/Subscriptions,7", false},
+		{"GET", "/RunJob,integritycheck", "PROD", "", "/RunJob,integritycheck", false},
+		{"GET", "/CancelJob,integritycheck", "PROD", "", "/CancelJob,integritycheck", false},
+		{"GET", "/FixTicket,CSDFK-1234", "PROD", "", "/FixTicket,CSDFK-1234", false},
+		{"GET", "/IntegrityCheck,rebaseline", "PROD", "", "/IntegrityCheck,rebaseline", false},
+		{"GET", "/IntegrityCheck,html", "", "", "/IntegrityCheck,html", false},
+		{"GET", "/GraphCheck", "", "", "/GraphCheck", false},
+		{"GET", "/Dispatch", "PROD", "", "/Dispatch", false},
+		{"GET", "/Notifications,Dispatch", "PROD", "", "/Notifications,Dispatch", false}, // the handler would dispatch
+	} {
+		r := httptest.NewRequest(c.method, c.target, nil)
+		if c.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: cENVIRONMENTCOOKIE, Value: c.cookie})
+		}
+
+		name, path, chosen := requestEnvironment(r)
+		if name != c.name || path != c.path || chosen != c.chosen {
+			t.Errorf("%s %s (cookie %q): %q, %q, %v, want %q, %q, %v",
+				c.method, c.target, c.cookie, name, path, chosen, c.name, c.path, c.chosen)
+		}
+	}
+}
+
+func TestEnvironmentHandlerRefusesUnnamedActions(t *testing.T) {
+
+	useConfig(t)
+	sessionConfig.Environments = []environmentConfig{{Name: "PROD"}}
+
+	r := httptest.NewRequest("GET", "/RunJob,dispatch", nil)
+	r.AddCookie(&http.Cookie{Name: cENVIRONMENTCOOKIE, Value: "PROD"})
+	w := httptest.NewRecorder()
+	environmentHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+
+	for _, c := range []struct {
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"10.1.2.3:5100", nil, "10.1.2.3:5100"},
+		{"10.1.2.3:5100", []string{"192.0.2.9"}, "10.1.2.3:5100"}, // not from the main process, not trusted
+		{"127.0.0.1:5100", nil, "127.0.0.1:5100"},
+		{"127.0.0.1:5100", []string{"10.1.2.3"}, "10.1.2.3"},
+		{"[::1]:5100", []string{"10.1.2.3"}, "10.1.2.3"},
+		{"127.0.0.1:5100", []string{"192.0.2.9, 10.1.2.3"}, "10.1.2.3"}, // the client's own header comes first
+		{"127.0.0.1:5100", []string{"192.0.2.9", "10.1.2.3"}, "10.1.2.3"},
+		{"127.0.0.1:5100", []string{""}, "127.0.0.1:5100"},
+	} {
+		r := httptest.NewRequest("GET", "/Ack,1,x", nil)
+		r.RemoteAddr = c.remote
+		for _, f := range c.forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+
+		if got := clientAddress(r); got != c.want {
+			t.Errorf("from %s with %q: %q, want %q", c.remote, c.forwarded, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Notification and Dashboard Service for DAM
+//
+// a fake smtp server for trying out dispatch locally: DAMInform -fakesmtp [port] [folder]
+// it accepts any sender, recipient and login, and writes each message it receives to folder as an .eml file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var fakeSMTPCount int64
+
+// listens on localhost:port until killed.
+func runFakeSMTP(port, folder string) error {
+
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	log.Println("DAMInform fake smtp listening on 127.0.0.1:" + port + ", writing messages to " + folder)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveFakeSMTP(conn, folder)
+	}
+}
+
+// one smtp session, just enough of RFC 5321 for gomail and net/smtp.
+func serveFakeSMTP(conn net.Conn, folder string) {
+
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		fmt.Fprintf(conn, "%s\r\n", line)
+	}
+
+	from := ""
+	to := []string{}
+
+	reply("220 localhost DAMInform fake smtp ready")
+
+	for {
+		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250-8BITMIME")
+			reply("250 AUTH PLAIN LOGIN")
+		case "HELO":
+			reply("250 localhost")
+		case "AUTH":
+			// LOGIN asks for the username and password in turn; PLAIN may send them on the AUTH line
+			fields := strings.Fields(line)
+			if len(fields) > 1 && strings.ToUpper(fields[1]) == "LOGIN" {
+				reply("334 VXNlcm5hbWU6")
+				r.ReadString('\n')
+				reply("334 UGFzc3dvcmQ6")
+				r.ReadString('\n')
+			} else if len(fields) == 2 {
+				reply("334 ")
+				r.ReadString('\n')
+			}
+			reply("235 2.7.0 Authentication successful")
+		case "MAIL":
+			from = fakeSMTPArgument(line)
+			to = []string{}
+			reply("250 OK")
+		case "RCPT":
+			to = append(to, fakeSMTPArgument(line))
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			message, err := readFakeSMTPData(r)
+			if err != nil {
+				return
+			}
+			name, err := saveFakeSMTPMessage(folder, from, to, message)
+			if err != nil {
+				reply("451 " + err.Error())
+				continue
+			}
+			log.Println("DAMInform fake smtp: " + from + " -> " + strings.Join(to, ",") + " saved as " + name)
+			reply("250 OK")
+		case "RSET":
+			from = ""
+			to = []string{}
+			reply("250 OK")
+		case "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// the address in "MAIL FROM:<a@b>" or "RCPT TO:<a@b>"
+func fakeSMTPArgument(line string) string {
+
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+
+	// drop any parameters after the address, e.g. BODY=8BITMIME
+	fields := strings.Fields(parts[1])
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return fields[0]
+}
+
+func readFakeSMTPData(r *bufio.Reader) (string, error) {
+
+	var b strings.Builder
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line == ".\r\n" || line == ".\n" {
+			return b.String(), nil
+		}
+		// undo dot-stuffing
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		b.WriteString(line)
+	}
+}
+
+func saveFakeSMTPMessage(folder, from string, to []string, message string) (string, error) {
+
+	n := atomic.AddInt64(&fakeSMTPCount, 1)
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().Format("20060102-150405"), n)
+
+	envelope := fmt.Sprintf("X-Fake-SMTP-From: %s\r\nX-Fake-SMTP-To: %s\r\n", from, strings.Join(to, ", "))
+
+	return name, os.WriteFile(filepath.Join(folder, name), []byte(envelope+message), 0644)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a fake smtp server on a free localhost port, with sessionConfig pointed at it; returns the folder it saves to.
+func startFakeSMTP(t *testing.T) string {
+
+	t.Helper()
+
+	folder := t.TempDir()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn, folder)
+		}
+	}()
+
+	useConfig(t)
+
+	sessionConfig.SMTPHost = "127.0.0.1"
+	sessionConfig.SMTPPort = listener.Addr().(*net.TCPAddr).Port
+	sessionConfig.SMTPSecurity = cSMTPNONE
+	sessionConfig.SMTPUser = ""
+	sessionConfig.SenderAddress = "noreply@example.com"
+	sessionConfig.SenderName = "DAM"
+
+	return folder
+}
+
+// the messages the fake server saved, in the order received.
+func fakeSMTPMessages(t *testing.T, folder string) []string {
+
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(folder, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []string{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, string(content))
+	}
+
+	return messages
+}
+
+func TestSMTPNotifierSendsThroughFakeSMTP(t *testing.T) {
+
+	folder := startFakeSMTP(t)
+
+	notifier := &smtpNotifier{name: cCHANNELSMTP}
+	err := notifier.Notify(outboundMessage{
+		To:      []string{"lead@example.com"},
+		Cc:      []string{"manager@example.com"},
+		Subject: "DAM: CSDFK-1234",
+		HTML:    "<p>Problems with <b>Sepsis.oet</b></p>",
+		Text:    "Problems with Sepsis.oet",
+	})
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	messages := fakeSMTPMessages(t, folder)
+	if len(messages) != 1 {
+		t.Fatalf("%d messages saved, want 1", len(messages))
+	}
+
+	message := messages[0]
+	for _, want := range []string{
+		"X-Fake-SMTP-From: <noreply@example.com>",
+		"<lead@example.com>",
+		"<manager@example.com>",
+		"Subject: DAM: CSDFK-1234",
+		"Problems with Sepsis.oet",
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message does not contain %q:\n%s", want, message)
+		}
+	}
+}
+
+func TestSMTPNotifierSendsCcOnly(t *testing.T) {
+
+	folder := startFakeSMTP(t)
+
+	notifier := &smtpNotifier{name: cCHANNELSMTP}
+	err := notifier.Notify(outboundMessage{
+		Cc:      []string{"manager@example.com"},
+		Subject: "DAM: integrity",
+		HTML:    "<p>integrity</p>",
+	})
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	messages := fakeSMTPMessages(t, folder)
+	if len(messages) != 1 {
+		t.Fatalf("%d messages saved, want 1", len(messages))
+	}
+	if !strings.Contains(messages[0], "X-Fake-SMTP-To: <manager@example.com>") {
+		t.Errorf("not sent to the cc:\n%s", messages[0])
+	}
+	if strings.Contains(messages[0], "\r\nTo:") {
+		t.Errorf("empty To header sent:\n%s", messages[0])
+	}
+}
+
+func TestSMTPNotifierRefusesNoRecipients(t *testing.T) {
+
+	notifier := &smtpNotifier{name: cCHANNELSMTP}
+	if err := notifier.Notify(outboundMessage{Subject: "DAM: nobody"}); err == nil {
+		t.Error("Notify with no recipients succeeded")
+	}
+}
+
+func TestSMTPNotifierStartTLSRefusesPlainServers(t *testing.T) {
+
+	folder := startFakeSMTP(t)
+	sessionConfig.SMTPSecurity = cSMTPSTARTTLS
+
+	notifier := &smtpNotifier{name: cCHANNELSMTP}
+	err := notifier.Notify(outboundMessage{
+		To:      []string{"lead@example.com"},
+		Subject: "DAM: CSDFK-1234",
+		HTML:    "<p>Problems with Sepsis.oet</p>",
+	})
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("Notify to a server without STARTTLS: %v, want it refused", err)
+	}
+	if messages := fakeSMTPMessages(t, folder); len(messages) > 0 {
+		t.Errorf("%d messages sent in the clear", len(messages))
+	}
+}
+
+func TestSMTPEnvelope(t *testing.T) {
+
+	useConfig(t)
+	sessionConfig.SenderAddress = "noreply@example.com"
+	sessionConfig.SenderName = "DAM Inform"
+
+	from, recipients, err := smtpEnvelope(buildMailMessage(outboundMessage{
+		To: []string{"Lead <lead@example.com>"},
+		Cc: []string{"manager@example.com"},
+	}))
+	if err != nil {
+		t.Fatalf("smtpEnvelope: %v", err)
+	}
+	if from != "noreply@example.com" {
+		t.Errorf("from %q, want the bare sender address", from)
+	}
+	if want := []string{"lead@example.com", "manager@example.com"}; strings.Join(recipients, ",") != strings.Join(want, ",") {
+		t.Errorf("recipients %v, want %v", recipients, want)
+	}
+
+	if _, _, err = smtpEnvelope(buildMailMessage(outboundMessage{})); err == nil {
+		t.Error("no error for a message with no recipients")
+	}
+}
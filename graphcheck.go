@@ -0,0 +1,394 @@
+// Notification and Dashboard Service for DAM
+//
+// relationship graph checks: getWUR() and getParents() trust mirrorstate_relationships; this looks for what would
+// make their reports wrong - relationships to missing templates, templates without a CKM cid, duplicate
+// relationships, cycles, and released relationships under a parent that is not released
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq" // golang postgres db driver
+)
+
+// notificationqueue.kind for relationship graph problems
+const cKINDGRAPH = "graph"
+
+// graphProblem.Kind values
+const (
+	cGRAPHMISSINGPARENT    = "parent missing from mirrorstate"
+	cGRAPHMISSINGCHILD     = "child missing from mirrorstate"
+	cGRAPHNOCID            = "no CKM cid"
+	cGRAPHDUPLICATE        = "duplicate relationship"
+	cGRAPHCYCLE            = "cycle"
+	cGRAPHUNRELEASEDPARENT = "released under an unreleased parent"
+)
+
+// cycles beyond this many are counted, not listed
+const cGRAPHMAXCYCLES = 100
+
+// one problem with the graph; for a cycle, Path holds the templates around it
+type graphProblem struct {
+	Kind     string   `json:"kind"`
+	ParentID string   `json:"parentid,omitempty"`
+	Parent   string   `json:"parent,omitempty"` // mirrorstate filename, when there is one
+	ChildID  string   `json:"childid,omitempty"`
+	Child    string   `json:"child,omitempty"`
+	Path     []string `json:"path,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+type graphResult struct {
+	Started       time.Time      `json:"started"`
+	DurationMS    int64          `json:"durationms"`
+	Templates     int            `json:"templates"`
+	Relationships int            `json:"relationships"`
+	Problems      []graphProblem `json:"problems"`
+	Totals        map[string]int `json:"totals"` // by kind
+	CyclesOmitted int            `json:"cyclesomitted"`
+}
+
+func (result *graphResult) addProblem(p graphProblem) {
+	result.Problems = append(result.Problems, p)
+	result.Totals[p.Kind]++
+}
+
+// a mirrorstate_relationships row
+type graphEdge struct {
+	parentid string
+	childid  string
+	released bool
+}
+
+// runs every check against mirrorstate and mirrorstate_relationships as they are now.
+func doGraphCheck(ctx context.Context, result *graphResult) bool {
+
+	result.Started = time.Now()
+	result.Problems = []graphProblem{}
+	result.Totals = make(map[string]int)
+
+	defer func() {
+		result.DurationMS = time.Since(result.Started).Milliseconds()
+	}()
+
+	names := make(map[string]string) // templateid -> filename
+
+	rows, err := db.QueryContext(ctx, `SELECT templateid, coalesce(filename, ''), cid FROM public.mirrorstate`)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	for rows.Next() {
+		templateid := ""
+		filename := ""
+		var cid sql.NullString
+		if err = rows.Scan(&templateid, &filename, &cid); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		names[templateid] = filename
+		if strings.TrimSpace(cid.String) == "" {
+			result.addProblem(graphProblem{Kind: cGRAPHNOCID, ChildID: templateid, Child: filename})
+		}
+	}
+	rows.Close()
+	result.Templates = len(names)
+
+	// a parent counts as released when CKM has it with a cid
+	released := make(map[string]bool)
+	rows, err = db.QueryContext(ctx, `SELECT resourcemainid FROM public.ckmresource WHERE coalesce(cid, '') <> ''`)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	for rows.Next() {
+		id := ""
+		if err = rows.Scan(&id); err == nil {
+			released[id] = true
+		}
+	}
+	rows.Close()
+
+	edges := []graphEdge{}
+	rows, err = db.QueryContext(ctx, `SELECT parentid, childid, coalesce(isreleased, false) FROM public.mirrorstate_relationships`)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	for rows.Next() {
+		e := graphEdge{}
+		if err = rows.Scan(&e.parentid, &e.childid, &e.released); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		edges = append(edges, e)
+	}
+	rows.Close()
+	result.Relationships = len(edges)
+
+	children := make(map[string][]string)
+	seen := make(map[[2]string]int)       // parentid, childid -> rows
+	duplicates := make(map[[2]string]int) // -> index in result.Problems
+
+	for _, e := range edges {
+
+		p := graphProblem{ParentID: e.parentid, Parent: names[e.parentid], ChildID: e.childid, Child: names[e.childid]}
+
+		if _, ok := names[e.parentid]; !ok {
+			p.Kind = cGRAPHMISSINGPARENT
+			result.addProblem(p)
+		}
+		if _, ok := names[e.childid]; !ok {
+			p.Kind = cGRAPHMISSINGCHILD
+			result.addProblem(p)
+		}
+		if e.released && !released[e.parentid] {
+			p.Kind = cGRAPHUNRELEASEDPARENT
+			result.addProblem(p)
+		}
+
+		key := [2]string{e.parentid, e.childid}
+		seen[key]++
+		switch seen[key] {
+		case 1:
+			children[e.parentid] = append(children[e.parentid], e.childid)
+		case 2:
+			p.Kind = cGRAPHDUPLICATE
+			duplicates[key] = len(result.Problems)
+			result.addProblem(p)
+		}
+	}
+
+	for key, i := range duplicates {
+		result.Problems[i].Detail = fmt.Sprintf("%d rows", seen[key])
+	}
+
+	for _, cycle := range findCycles(children) {
+		if result.Totals[cGRAPHCYCLE] == cGRAPHMAXCYCLES {
+			result.CyclesOmitted++
+			continue
+		}
+		path := make([]string, len(cycle))
+		for i, id := range cycle {
+			path[i] = firstOf(names[id], id)
+		}
+		result.addProblem(graphProblem{Kind: cGRAPHCYCLE, ParentID: cycle[0], Parent: names[cycle[0]], Path: path})
+	}
+
+	sort.SliceStable(result.Problems, func(i, j int) bool { return result.Problems[i].Kind < result.Problems[j].Kind })
+
+	return ctx.Err() == nil
+}
+
+// the elementary cycles reachable in a depth-first walk of the graph, each once, starting at its smallest id.
+func findCycles(children map[string][]string) [][]string {
+
+	const (
+		unvisited = iota
+		onstack
+		done
+	)
+
+	state := make(map[string]int)
+	stack := []string{}
+	position := make(map[string]int)
+	found := make(map[string]bool)
+	cycles := [][]string{}
+
+	parents := make([]string, 0, len(children))
+	for id := range children {
+		parents = append(parents, id)
+	}
+	sort.Strings(parents)
+
+	var visit func(id string)
+	visit = func(id string) {
+		state[id] = onstack
+		position[id] = len(stack)
+		stack = append(stack, id)
+
+		for _, child := range children[id] {
+			switch state[child] {
+			case unvisited:
+				visit(child)
+			case onstack:
+				cycle := append([]string{}, stack[position[child]:]...)
+				smallest := 0
+				for i := range cycle {
+					if cycle[i] < cycle[smallest] {
+						smallest = i
+					}
+				}
+				cycle = append(cycle[smallest:], cycle[:smallest]...)
+				key := strings.Join(cycle, ">")
+				if !found[key] {
+					found[key] = true
+					cycles = append(cycles, cycle)
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[id] = done
+	}
+
+	for _, id := range parents {
+		if state[id] == unvisited {
+			visit(id)
+		}
+	}
+
+	return cycles
+}
+
+// the graph check job: a graph notification while there are problems, resolved once there are none.
+func doGraphCheckJob(ctx context.Context) (string, error) {
+
+	result := graphResult{}
+	if !doGraphCheck(ctx, &result) {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("relationship graph check could not complete")
+	}
+
+	if len(result.Problems) == 0 {
+		resolveNotifications(cKINDGRAPH, "", "", "The template relationship graph is consistent again.")
+		return fmt.Sprintf("%d templates, %d relationships, no problems", result.Templates, result.Relationships), nil
+	}
+
+	notificationmessage := fmt.Sprintf("%d problems in the template relationship graph:", len(result.Problems)) + formatGraphTotals(result)
+
+	_, err := db.Exec(`INSERT INTO public.notificationqueue
+		(message, jirakey, asset, created, notifymgr, lead, kind)
+		VALUES( $1, $2, $3, $4, $5, $6, $7);`,
+		notificationmessage,
+		"",
+		"",
+		time.Now(),
+		false,
+		"jon.beeby",
+		cKINDGRAPH,
+	)
+	if err, ok := err.(*pq.Error); ok {
+		logMessage("pq error:"+err.Code.Name()+" - "+err.Message, "", "ERROR")
+	}
+
+	return fmt.Sprintf("%d templates, %d relationships, %d problems", result.Templates, result.Relationships, len(result.Problems)), nil
+}
+
+// e.g. <ul><li>cycle: 2</li>...</ul>
+func formatGraphTotals(result graphResult) string {
+
+	kinds := make([]string, 0, len(result.Totals))
+	for kind := range result.Totals {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	totals := "<ul>"
+	for _, kind := range kinds {
+		totals += fmt.Sprintf("<li>%s: %d</li>", kind, result.Totals[kind])
+	}
+	totals += "</ul>"
+
+	return totals
+}
+
+func getGraphCheckJSON(report *string, result graphResult, ok bool) bool {
+
+	document := struct {
+		Complete bool `json:"complete"`
+		graphResult
+	}{ok, result}
+
+	content, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+
+	*report += string(content)
+
+	return true
+}
+
+func getGraphCheckReport(report *string, result graphResult, ok bool) bool {
+
+	tabledef := ""
+	tableheader := ""
+	tablebody := ""
+
+	log.Println("DAMInform.getGraphCheckReport() ....")
+
+	status := "complete"
+	if !ok {
+		status = "did not complete"
+	}
+
+	tableheader += "<h1>Template relationship graph</h1>"
+	tableheader += fmt.Sprintf("<p>%s, %s in %d ms: %d templates, %d relationships, %d problems.</p>",
+		result.Started.Format("Mon Jan _2 2006 @ 15:04"), status, result.DurationMS, result.Templates, result.Relationships, len(result.Problems))
+	tableheader += formatGraphTotals(result)
+	if result.CyclesOmitted > 0 {
+		tableheader += fmt.Sprintf("<p>%d more cycles not listed.</p>", result.CyclesOmitted)
+	}
+
+	tableheader += "<thead><tr>"
+	tableheader += "<th>Problem</th><th>Parent</th><th>Child</th><th>Detail</th>"
+	tableheader += "</tr></thead>"
+	tablebody += "<tbody>"
+
+	for _, p := range result.Problems {
+
+		detail := p.Detail
+		if len(p.Path) > 0 {
+			detail = strings.Join(append(p.Path, p.Path[0]), " → ")
+		}
+
+		tablebody += "<tr>"
+		tablebody += fmt.Sprintf("<th class='row-header'>%s</th>", p.Kind)
+		tablebody += fmt.Sprintf("<td>%s</td>", formatGraphTemplate(p.Parent, p.ParentID))
+		tablebody += fmt.Sprintf("<td>%s</td>", formatGraphTemplate(p.Child, p.ChildID))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(detail))
+		tablebody += "</tr>"
+	}
+
+	tablebody += "</tbody>"
+
+	tabledef = tableheader + tablebody
+
+	overlaptemplate, _ := readlines2("html/reporttemplate.html")
+
+	var line string
+	for i := range overlaptemplate {
+		line = overlaptemplate[i]
+		line = strings.Replace(line, "<cdata>%%TABLE%%</cdata>", tabledef, -1)
+		*report += line
+	}
+
+	return true
+}
+
+// a template's name with its id, linked to its where used report.
+func formatGraphTemplate(name, id string) string {
+
+	if id == "" {
+		return ""
+	}
+	if name == "" {
+		return html.EscapeString(id)
+	}
+
+	return fmt.Sprintf("<a href='%s'>%s</a> <span style='color: #777;'>%s</span>",
+		environmentPath("/WhereUsed,"+html.EscapeString(id)), html.EscapeString(assetDisplayName(name)), html.EscapeString(id))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindCycles(t *testing.T) {
+
+	for _, c := range []struct {
+		name     string
+		children map[string][]string
+		want     [][]string
+	}{
+		{"empty", map[string][]string{}, [][]string{}},
+		{"tree", map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}}, [][]string{}},
+		{"self", map[string][]string{"a": {"a"}}, [][]string{{"a"}}},
+		{"pair", map[string][]string{"b": {"a"}, "a": {"b"}}, [][]string{{"a", "b"}}},
+		{
+			// a cycle entered from outside, reached twice, and a self loop
+			"several",
+			map[string][]string{"a": {"b"}, "b": {"c", "d"}, "c": {"a"}, "d": {"d"}, "e": {"b"}},
+			[][]string{{"a", "b", "c"}, {"d"}},
+		},
+		{
+			// listed from its smallest id, whichever node the walk meets it at
+			"rotated",
+			map[string][]string{"z": {"y"}, "y": {"m"}, "m": {"z"}},
+			[][]string{{"m", "z", "y"}},
+		},
+		{"to a missing child", map[string][]string{"a": {"x"}}, [][]string{}},
+	} {
+		if got := findCycles(c.children); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: findCycles() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Notification and Dashboard Service for DAM
+//
+// DAMLogger heartbeat: drops a canary file into each ticket folder and waits for DAMLogger to record it in
+// activity_local. a folder whose canary goes unrecorded is one where changes to assets are being missed.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lib/pq" // golang postgres db driver
+)
+
+// notificationqueue.kind for folders DAMLogger is not watching
+const cKINDHEARTBEAT = "heartbeat"
+
+// canary files are named <prefix><run>-<n>.txt; the walkers never treat them as assets
+const cHEARTBEATPREFIX = "daminform-heartbeat-"
+
+// how often activity_local is looked at while waiting for canaries
+const cHEARTBEATPOLL = 5 * time.Second
+
+// one folder's canary
+type heartbeatResult struct {
+	Folder  string
+	Canary  string
+	Written time.Time
+	Seen    pq.NullTime // when DAMLogger recorded it
+	Detail  string      // why it failed
+}
+
+func (h heartbeatResult) ok() bool {
+	return h.Seen.Valid
+}
+
+func isHeartbeatCanary(name string) bool {
+	return strings.HasPrefix(name, cHEARTBEATPREFIX)
+}
+
+// writes a canary into each folder, waits up to config.HeartbeatTimeoutSeconds for DAMLogger to record them
+// all, then removes them. the activity_local rows canaries leave behind, from this run or earlier ones, go too.
+func checkHeartbeat(ctx context.Context, folders []string) []heartbeatResult {
+
+	run := time.Now()
+	results := make([]heartbeatResult, len(folders))
+	waiting := make(map[string]int) // canary -> index in results
+
+	for i, folder := range folders {
+		h := heartbeatResult{Folder: folder, Canary: fmt.Sprintf("%s%d-%d.txt", cHEARTBEATPREFIX, run.Unix(), i), Written: time.Now()}
+		path := filepath.Join(folder, h.Canary)
+		if err := os.WriteFile(path, []byte("DAMInform heartbeat "+run.Format(time.RFC3339)+"\n"), 0644); err != nil {
+			h.Detail = err.Error()
+		} else {
+			waiting[h.Canary] = i
+		}
+		results[i] = h
+	}
+
+	deadline := time.NewTimer(time.Duration(sessionConfig.HeartbeatTimeoutSeconds) * time.Second)
+	defer deadline.Stop()
+	poll := time.NewTicker(cHEARTBEATPOLL)
+	defer poll.Stop()
+
+	for len(waiting) > 0 {
+
+		select {
+		case <-poll.C:
+		case <-deadline.C:
+			for _, i := range waiting {
+				results[i].Detail = fmt.Sprintf("not recorded by DAMLogger within %d seconds", sessionConfig.HeartbeatTimeoutSeconds)
+			}
+			waiting = nil
+			continue
+		case <-ctx.Done():
+			for _, i := range waiting {
+				results[i].Detail = "check cancelled"
+			}
+			waiting = nil
+			continue
+		}
+
+		canaries := make([]string, 0, len(waiting))
+		for canary := range waiting {
+			canaries = append(canaries, canary)
+		}
+
+		rows, err := db.Query(`SELECT filename, min(optime) FROM public.activity_local
+			WHERE filename = ANY($1) GROUP BY filename`, pq.Array(canaries))
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		for rows.Next() {
+			canary := ""
+			var seen time.Time
+			if err = rows.Scan(&canary, &seen); err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			if i, ok := waiting[canary]; ok {
+				results[i].Seen = pq.NullTime{Time: seen, Valid: true}
+				delete(waiting, canary)
+			}
+		}
+		rows.Close()
+	}
+
+	for _, h := range results {
+		if err := os.Remove(filepath.Join(h.Folder, h.Canary)); err != nil && !os.IsNotExist(err) {
+			log.Println(err.Error())
+		}
+	}
+
+	_, err := db.Exec(`DELETE FROM public.activity_local WHERE filename LIKE $1`, cHEARTBEATPREFIX+"%")
+	if err, ok := err.(*pq.Error); ok {
+		fmt.Println("pq error:", err.Code.Name())
+		logMessage("Problems clearing heartbeat activity : "+err.Code.Name(), "", "ERROR")
+	}
+
+	return results
+}
+
+// the heartbeat job: every ticket folder in the changeset repository, recorded in public.heartbeat.
+// a folder that fails raises a heartbeat notification, which is resolved once every folder passes again.
+func doHeartbeat(ctx context.Context) (string, error) {
+
+	basePath := sessionConfig.ChangesetPath
+	started := time.Now()
+
+	entries, err := os.ReadDir(basePath)
+	if err != nil {
+		return "", err
+	}
+
+	folders := []string{}
+	for _, e := range entries {
+		if e.IsDir() && !ignoredFolder(e.Name()) && !strings.HasPrefix(e.Name(), ".") {
+			folders = append(folders, filepath.Join(basePath, e.Name()))
+		}
+	}
+
+	results := checkHeartbeat(ctx, folders)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
+	failed := []heartbeatResult{}
+
+	for _, h := range results {
+
+		if !h.ok() {
+			failed = append(failed, h)
+		}
+
+		latency := int64(0)
+		if h.ok() {
+			latency = h.Seen.Time.Sub(h.Written).Milliseconds()
+		}
+
+		_, err = db.Exec(`INSERT INTO public.heartbeat
+			(environment, started, folder, canary, written, seen, latencyms, ok, detail)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			basePath, started, filepath.Base(h.Folder), h.Canary, h.Written, h.Seen, latency, h.ok(), h.Detail)
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage("Problems recording heartbeat : "+err.Code.Name(), filepath.Base(h.Folder), "ERROR")
+		}
+	}
+
+	if len(failed) == 0 {
+		resolveNotifications(cKINDHEARTBEAT, "", "", "DAMLogger is recording changes on "+basePath+" again.")
+		return fmt.Sprintf("%d folders, all recorded", len(results)), nil
+	}
+
+	notificationmessage := fmt.Sprintf("DAMLogger did not record changes in %d of %d folders on %s:<ul>", len(failed), len(results), basePath)
+	for i, h := range failed {
+		if i == 20 {
+			notificationmessage += fmt.Sprintf("<li>and %d more</li>", len(failed)-20)
+			break
+		}
+		notificationmessage += fmt.Sprintf("<li>%s - %s</li>", html.EscapeString(filepath.Base(h.Folder)), html.EscapeString(h.Detail))
+		logMessage("HEARTBEAT: "+basePath+" - "+h.Detail, filepath.Base(h.Folder), "ERROR")
+	}
+	notificationmessage += "</ul>"
+
+	_, err = db.Exec(`INSERT INTO public.notificationqueue
+		(message, jirakey, asset, created, notifymgr, lead, kind)
+		VALUES( $1, $2, $3, $4, $5, $6, $7);`,
+		notificationmessage,
+		"",
+		"",
+		time.Now(),
+		true,
+		"jon.beeby",
+		cKINDHEARTBEAT,
+	)
+	if err, ok := err.(*pq.Error); ok {
+		logMessage("pq error:"+err.Code.Name()+" - "+err.Message, "", "ERROR")
+	}
+
+	return fmt.Sprintf("%d folders, %d not recorded", len(results), len(failed)), nil
+}
+
+// the heartbeat page: each folder's latest canary, failures first, then the recent runs.
+func getHeartbeat(report *string) bool {
+
+	tabledef := ""
+	tableheader := ""
+	tablebody := ""
+
+	log.Println("DAMInform.getHeartbeat() ....")
+
+	tableheader += "<h1>DAMLogger heartbeat</h1>"
+
+	rows, err := db.Query(`SELECT environment, started, count(*), count(*) filter (where ok), coalesce(max(latencyms) filter (where ok), 0)
+		FROM public.heartbeat
+		GROUP BY environment, started
+		ORDER BY started desc LIMIT 10`)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		environment := ""
+		var started time.Time
+		folders, passed := 0, 0
+		slowest := int64(0)
+		if err = rows.Scan(&environment, &started, &folders, &passed, &slowest); err != nil {
+			log.Println(err.Error())
+			return false
+		}
+		style := ""
+		if passed < folders {
+			style = " style='color: #a94442;'"
+		}
+		tableheader += fmt.Sprintf("<p%s>%s, %s: %d of %d folders recorded, the slowest in %d ms.</p>",
+			style, started.Format("Mon Jan _2 2006 @ 15:04"), html.EscapeString(environment), passed, folders, slowest)
+	}
+	rows.Close()
+
+	tableheader += "<thead><tr>"
+	tableheader += "<th>Folder</th><th>Environment</th><th>Written</th><th>Recorded</th><th>Latency (ms)</th><th>Status</th>"
+	tableheader += "</tr></thead>"
+	tablebody += "<tbody>"
+
+	rows, err = db.Query(`SELECT DISTINCT ON (environment, folder) environment, folder, written, seen, latencyms, ok, detail
+		FROM public.heartbeat
+		ORDER BY environment, folder, started desc`)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	defer rows.Close()
+
+	passing := ""
+	for rows.Next() {
+		environment := ""
+		h := heartbeatResult{}
+		latency := int64(0)
+		ok := false
+
+		err = rows.Scan(&environment, &h.Folder, &h.Written, &h.Seen, &latency, &ok, &h.Detail)
+		if err != nil {
+			log.Println(err.Error())
+			return false
+		}
+
+		row := "<tr>"
+		row += fmt.Sprintf("<th class='row-header'>%s</th>", html.EscapeString(h.Folder))
+		row += fmt.Sprintf("<td>%s</td>", html.EscapeString(environment))
+		row += fmt.Sprintf("<td>%s</td>", h.Written.Format("2006-01-02 15:04:05"))
+		row += fmt.Sprintf("<td>%s</td>", formatNullTime(h.Seen))
+		if ok {
+			row += fmt.Sprintf("<td>%d</td><td>ok</td>", latency)
+			passing += row + "</tr>"
+		} else {
+			row += fmt.Sprintf("<td></td><td style='color: #a94442;'>%s</td>", html.EscapeString(h.Detail))
+			tablebody += row + "</tr>"
+		}
+	}
+	tablebody += passing
+
+	tablebody += "</tbody>"
+
+	tabledef = tableheader + tablebody
+
+	overlaptemplate, _ := readlines2("html/reporttemplate.html")
+
+	var line string
+	for i := range overlaptemplate {
+		line = overlaptemplate[i]
+		line = strings.Replace(line, "<cdata>%%TABLE%%</cdata>", tabledef, -1)
+		*report += line
+	}
+
+	return true
+}
@@ -0,0 +1,312 @@
+// Notification and Dashboard Service for DAM
+//
+// integrity check results: every problem doIntegrityCheck() finds, with totals and walk statistics, as json or a report page
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq" // golang postgres db driver
+)
+
+// integrityProblem.Kind values
+const (
+	cPROBLEMMISSINGDAMASSET   = "missing in damasset"   // on disk, not tracked
+	cPROBLEMMISSINGFILESYSTEM = "missing in filesystem" // tracked, not on disk
+)
+
+// a public.damasset row, as the integrity check reads it
+type damassetRow struct {
+	Folder         string `json:"folder"`
+	Filename       string `json:"filename"`
+	FullFilePath   string `json:"fullfilepath"`
+	ResourceMainID string `json:"resourcemainid"`
+	Modified       bool   `json:"modified"`
+	IsLatest       bool   `json:"islatest"`
+}
+
+// one discrepancy between the changeset folders and damasset
+type integrityProblem struct {
+	Ticket   string       `json:"ticket"`
+	Asset    string       `json:"asset"`
+	Type     string       `json:"type,omitempty"` // the asset type, for files on disk
+	Kind     string       `json:"kind"`
+	Path     string       `json:"path"`               // where the file is, or where damasset says it should be
+	DamAsset *damassetRow `json:"damasset,omitempty"` // the row, when there is one
+	Detail   string       `json:"detail,omitempty"`   // content drift: what changed
+
+	FirstSeen time.Time `json:"firstseen"` // the start of the first run that found it, see integrityhistory.go
+}
+
+type integrityResult struct {
+	Environment      string             `json:"environment"`      // the ChangesetPath checked
+	Deep             bool               `json:"deep"`             // file content was compared too, see contentcheck.go
+	TemplatesChecked bool               `json:"templateschecked"` // templates were read, see templatecheck.go
+	Rebaseline       bool               `json:"rebaseline"`       // deep: take the files as they are now as correct
+	Started          time.Time          `json:"started"`
+	Finished         time.Time          `json:"finished"`
+	DurationMS       int64              `json:"durationms"`
+	Problems         []integrityProblem `json:"problems"`
+	RunID            int                `json:"runid"`
+	New              []integrityProblem `json:"new"`      // problems the previous run did not have
+	Resolved         []integrityProblem `json:"resolved"` // problems the previous run had and this one does not
+
+	Totals struct {
+		Problems            int `json:"problems"`
+		MissingInDamasset   int `json:"missingindamasset"`
+		MissingInFilesystem int `json:"missinginfilesystem"`
+		DamassetRows        int `json:"damassetrows"`
+		ContentDrift        int `json:"contentdrift"`
+		MalformedTemplates  int `json:"malformedtemplates"`
+		TemplateMismatches  int `json:"templatemismatches"`
+	} `json:"totals"`
+
+	DriftByTicket map[string]int `json:"driftbyticket,omitempty"`
+
+	Content struct {
+		Checked   int `json:"checked"`   // files fingerprinted
+		Baselined int `json:"baselined"` // seen for the first time
+		Updated   int `json:"updated"`   // changed, and damasset knew
+		Templates int `json:"templates"` // read as xml, see templatecheck.go
+	} `json:"content"`
+
+	Walk struct {
+		Folders int      `json:"folders"`
+		Files   int      `json:"files"`
+		Assets  int      `json:"assets"` // files of a tracked asset type among them
+		Errors  []string `json:"errors"`
+
+		AssetsByType map[string]int `json:"assetsbytype"`
+	} `json:"walk"`
+}
+
+// integrity checks, shallow or deep, scheduled or asked for over http, take turns: each opens and resolves
+// integrityproblem rows, and two at once would both try to open the same problem
+var integrityCheckRunning sync.Mutex
+
+// doIntegrityCheck() under the integrity lock, in this instance and across instances sharing the database.
+// returns errJobRunning if a check is already under way.
+func runIntegrityCheck(ctx context.Context, result *integrityResult) (bool, error) {
+
+	if !integrityCheckRunning.TryLock() {
+		return false, errJobRunning
+	}
+	defer integrityCheckRunning.Unlock()
+
+	// not a job's own name: the integritycheck jobs hold theirs while they call this
+	unlock, err := lockJob("integrity")
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	return doIntegrityCheck(ctx, result), nil
+}
+
+// problems as they go out: tracking ones in an integrity notification, template ones in a templatecontent one.
+func splitTemplateProblems(problems []integrityProblem) (tracking, templates []integrityProblem) {
+
+	for _, p := range problems {
+		if isTemplateProblem(p.Kind) {
+			templates = append(templates, p)
+		} else {
+			tracking = append(tracking, p)
+		}
+	}
+
+	return tracking, templates
+}
+
+// queues an integrity or templatecontent notification: what each kind of problem means, then the new ones.
+func queueIntegrityNotification(kind, heading string, problems, newproblems []integrityProblem) {
+
+	notificationmessage := heading + formatIntegrityProblemKinds(problems) + formatNewIntegrityProblems(newproblems)
+
+	_, err := db.Exec(`INSERT INTO public.notificationqueue
+		(message, jirakey, asset, created, notifymgr, lead, kind)
+		VALUES( $1, $2, $3, $4, $5, $6, $7);`,
+		notificationmessage,
+		"",
+		"",
+		time.Now(),
+		true,
+		"jon.beeby",
+		kind,
+	)
+	if err, ok := err.(*pq.Error); ok {
+		logMessage("pq error:"+err.Code.Name()+" - "+err.Message, "", "ERROR")
+	}
+}
+
+func (result *integrityResult) addProblem(p integrityProblem) {
+
+	result.Problems = append(result.Problems, p)
+
+	result.Totals.Problems++
+	switch p.Kind {
+	case cPROBLEMMISSINGDAMASSET:
+		result.Totals.MissingInDamasset++
+	case cPROBLEMMISSINGFILESYSTEM:
+		result.Totals.MissingInFilesystem++
+	case cPROBLEMCONTENTDRIFT:
+		result.Totals.ContentDrift++
+		if result.DriftByTicket == nil {
+			result.DriftByTicket = make(map[string]int)
+		}
+		result.DriftByTicket[p.Ticket]++
+	case cPROBLEMMALFORMEDTEMPLATE:
+		result.Totals.MalformedTemplates++
+	case cPROBLEMTEMPLATEMISMATCH:
+		result.Totals.TemplateMismatches++
+	}
+}
+
+// by ticket, then asset, so that runs compare line by line.
+func (result *integrityResult) sortProblems() {
+
+	sort.Slice(result.Problems, func(i, j int) bool {
+		a, b := result.Problems[i], result.Problems[j]
+		if a.Ticket != b.Ticket {
+			return a.Ticket < b.Ticket
+		}
+		if a.Asset != b.Asset {
+			return a.Asset < b.Asset
+		}
+		return a.Kind < b.Kind
+	})
+}
+
+func (result *integrityResult) finish() {
+
+	result.Finished = time.Now()
+	result.DurationMS = result.Finished.Sub(result.Started).Milliseconds()
+
+	if result.Problems == nil {
+		result.Problems = []integrityProblem{}
+	}
+	if result.New == nil {
+		result.New = []integrityProblem{}
+	}
+	if result.Resolved == nil {
+		result.Resolved = []integrityProblem{}
+	}
+	if result.Walk.Errors == nil {
+		result.Walk.Errors = []string{}
+	}
+	if result.Walk.AssetsByType == nil {
+		result.Walk.AssetsByType = make(map[string]int)
+	}
+}
+
+// ok is false when the check could not complete; the result then holds what was found before it stopped.
+func getIntegrityJSON(report *string, result integrityResult, ok bool) bool {
+
+	document := struct {
+		Complete bool `json:"complete"`
+		integrityResult
+	}{ok, result}
+
+	content, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+
+	*report += string(content)
+
+	return true
+}
+
+func getIntegrityReport(report *string, result integrityResult, ok bool) bool {
+
+	tabledef := ""
+	tableheader := ""
+	tablebody := ""
+
+	log.Println("DAMInform.getIntegrityReport() ....")
+
+	status := "complete"
+	if !ok {
+		status = "did not complete"
+	}
+
+	tableheader += fmt.Sprintf("<h1>Integrity check - %s</h1>", html.EscapeString(result.Environment))
+	tableheader += fmt.Sprintf("<p>%s, %s in %d ms: %d problems (%d missing in damasset, %d missing in filesystem) among %d damasset rows.</p>",
+		result.Started.Format("Mon Jan _2 2006 @ 15:04"), status, result.DurationMS,
+		result.Totals.Problems, result.Totals.MissingInDamasset, result.Totals.MissingInFilesystem, result.Totals.DamassetRows)
+	types := []string{}
+	for _, t := range sessionConfig.AssetTypes {
+		types = append(types, fmt.Sprintf("%d %s", result.Walk.AssetsByType[t.Name], t.Name))
+	}
+	tableheader += fmt.Sprintf("<p>Walked %d folders and %d files, %d assets (%s); %d errors.</p>",
+		result.Walk.Folders, result.Walk.Files, result.Walk.Assets, strings.Join(types, ", "), len(result.Walk.Errors))
+	if result.TemplatesChecked {
+		tableheader += fmt.Sprintf("<p>Templates: %d read, %d malformed, %d disagreeing with damasset or mirrorstate.</p>",
+			result.Content.Templates, result.Totals.MalformedTemplates, result.Totals.TemplateMismatches)
+	}
+	if result.Deep {
+		tableheader += fmt.Sprintf("<p>Content: %d files fingerprinted, %d seen for the first time, %d changed with damasset aware; %d drifted.</p>",
+			result.Content.Checked, result.Content.Baselined, result.Content.Updated, result.Totals.ContentDrift)
+		tickets := make([]string, 0, len(result.DriftByTicket))
+		for ticket := range result.DriftByTicket {
+			tickets = append(tickets, ticket)
+		}
+		sort.Strings(tickets)
+		for _, ticket := range tickets {
+			tableheader += fmt.Sprintf("<p>%s: %d files changed on disk without damasset noticing</p>", html.EscapeString(ticket), result.DriftByTicket[ticket])
+		}
+	}
+	for _, e := range result.Walk.Errors {
+		tableheader += fmt.Sprintf("<p style='color: #a94442;'>%s</p>", html.EscapeString(e))
+	}
+
+	tableheader += fmt.Sprintf("<p>%d new and %d resolved since the last check - see the <a href='%s'>history</a>.</p>",
+		len(result.New), len(result.Resolved), environmentPath("/IntegrityHistory"))
+
+	tableheader += "<thead><tr>"
+	tableheader += "<th>Ticket</th><th>Asset</th><th>Problem</th><th>Path</th><th>damasset</th><th>First seen</th>"
+	tableheader += "</tr></thead>"
+	tablebody += "<tbody>"
+
+	for _, p := range result.Problems {
+
+		damasset := p.Detail
+		if p.DamAsset != nil && p.Detail == "" {
+			damasset = fmt.Sprintf("%s / %s, resourcemainid %s, modified %t, latest %t",
+				p.DamAsset.Folder, p.DamAsset.Filename, p.DamAsset.ResourceMainID, p.DamAsset.Modified, p.DamAsset.IsLatest)
+		}
+
+		tablebody += "<tr>"
+		tablebody += fmt.Sprintf("<th class='row-header'>%s</th>", html.EscapeString(p.Ticket))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(p.Asset))
+		tablebody += fmt.Sprintf("<td>%s</td>", strings.TrimSpace(p.Type+" "+p.Kind))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(p.Path))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(damasset))
+		tablebody += fmt.Sprintf("<td>%s</td>", p.FirstSeen.Format("2006-01-02 15:04"))
+		tablebody += "</tr>"
+	}
+
+	tablebody += "</tbody>"
+
+	tabledef = tableheader + tablebody
+
+	overlaptemplate, _ := readlines2("html/reporttemplate.html")
+
+	var line string
+	for i := range overlaptemplate {
+		line = overlaptemplate[i]
+		line = strings.Replace(line, "<cdata>%%TABLE%%</cdata>", tabledef, -1)
+		*report += line
+	}
+
+	return true
+}
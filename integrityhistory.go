@@ -0,0 +1,399 @@
+// Notification and Dashboard Service for DAM
+//
+// integrity check history: every run and every problem it finds are kept, so that a discrepancy can be
+// followed from when it first appeared until it was resolved, and each run knows what is new since the last
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq" // golang postgres db driver
+)
+
+// how far back the history page's trend chart goes
+const cINTEGRITYHISTORYDAYS = 90
+
+// stores a run and brings the problem history up to date with it: problems seen for the first time
+// are opened and go into result.New, open problems this run no longer finds are closed and go into result.Resolved.
+// an incomplete run only records what it saw, it resolves nothing.
+func recordIntegrityRun(result *integrityResult, complete bool) bool {
+
+	result.finish()
+
+	err := db.QueryRow(`INSERT INTO public.integrityrun
+		(environment, started, finished, durationms, complete, problems, folders, files, assets, errors)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+		result.Environment, result.Started, result.Finished, result.DurationMS, complete,
+		len(result.Problems), result.Walk.Folders, result.Walk.Files, result.Walk.Assets, len(result.Walk.Errors)).Scan(&result.RunID)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems recording integrity run : %s", err.Code.Name()), "", "ERROR")
+		}
+		return false
+	}
+
+	open := getOpenIntegrityProblems(result.Environment)
+	seen := make(map[string]bool)
+
+	for i := range result.Problems {
+
+		p := &result.Problems[i]
+		key := p.key()
+		seen[key] = true
+
+		if firstseen, ok := open[key]; ok {
+			p.FirstSeen = firstseen.FirstSeen
+			_, err = db.Exec(`UPDATE public.integrityproblem SET lastseen = $1, lastrun = $2, path = $3
+				WHERE environment = $4 and ticket = $5 and asset = $6 and kind = $7 and resolved is null`,
+				result.Started, result.RunID, p.Path, result.Environment, p.Ticket, p.Asset, p.Kind)
+		} else {
+			p.FirstSeen = result.Started
+			result.New = append(result.New, *p)
+			_, err = db.Exec(`INSERT INTO public.integrityproblem
+				(environment, ticket, asset, kind, path, firstseen, lastseen, firstrun, lastrun)
+				VALUES($1, $2, $3, $4, $5, $6, $6, $7, $7)`,
+				result.Environment, p.Ticket, p.Asset, p.Kind, p.Path, result.Started, result.RunID)
+		}
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems recording integrity problem %s : %s", key, err.Code.Name()), p.Ticket, "ERROR")
+		}
+	}
+
+	if complete {
+		for key, p := range open {
+			// a run can only see gone the kinds of problem it looks for
+			if seen[key] || !result.looksFor(p.Kind) {
+				continue
+			}
+			result.Resolved = append(result.Resolved, p)
+			_, err = db.Exec(`UPDATE public.integrityproblem SET resolved = $1, resolvedrun = $2
+				WHERE environment = $3 and ticket = $4 and asset = $5 and kind = $6 and resolved is null`,
+				result.Started, result.RunID, result.Environment, p.Ticket, p.Asset, p.Kind)
+			if err, ok := err.(*pq.Error); ok {
+				fmt.Println("pq error:", err.Code.Name())
+				logMessage(fmt.Sprintf("Problems resolving integrity problem %s : %s", key, err.Code.Name()), p.Ticket, "ERROR")
+			}
+		}
+	}
+
+	_, err = db.Exec(`UPDATE public.integrityrun SET newproblems = $1, resolvedproblems = $2 WHERE id = $3`,
+		len(result.New), len(result.Resolved), result.RunID)
+	if err, ok := err.(*pq.Error); ok {
+		fmt.Println("pq error:", err.Code.Name())
+	}
+
+	sort.Slice(result.Resolved, func(i, j int) bool { return result.Resolved[i].key() < result.Resolved[j].key() })
+
+	return true
+}
+
+// whether a run looks for a kind of problem: content drift only a deep check, templates when they were read.
+func (result *integrityResult) looksFor(kind string) bool {
+
+	switch {
+	case kind == cPROBLEMCONTENTDRIFT:
+		return result.Deep
+	case isTemplateProblem(kind):
+		return result.TemplatesChecked
+	}
+
+	return true
+}
+
+// how many problems of each kind are still open in an environment, whichever run found them.
+func getOpenIntegrityKinds(environment string) (map[string]int, bool) {
+
+	kinds := make(map[string]int)
+
+	rows, err := db.Query(`SELECT kind, count(*) FROM public.integrityproblem
+		WHERE environment = $1 and resolved is null GROUP BY kind`, environment)
+	if err != nil {
+		log.Println(err.Error())
+		return kinds, false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		kind := ""
+		count := 0
+		if err = rows.Scan(&kind, &count); err != nil {
+			log.Println(err.Error())
+			return kinds, false
+		}
+		kinds[kind] = count
+	}
+
+	return kinds, true
+}
+
+// what each kind of problem means, for the notification
+var integrityProblemWording = map[string]string{
+	cPROBLEMMISSINGDAMASSET:   "%d files are not in damasset: DAMLogger did not record them, and should be restarted for this environment.",
+	cPROBLEMMISSINGFILESYSTEM: "%d damasset rows have no file: removed or moved without DAMLogger recording it.",
+	cPROBLEMCONTENTDRIFT:      "%d files have changed on disk since they were last fingerprinted, without damasset being told.",
+	cPROBLEMMALFORMEDTEMPLATE: "%d templates are not well formed, corrupted or only partly synced.",
+	cPROBLEMTEMPLATEMISMATCH:  "%d templates have an id or name that disagrees with damasset or mirrorstate.",
+}
+
+// e.g. <ul><li>3 files are not in damasset: ...</li></ul>, a line for each kind of problem found.
+func formatIntegrityProblemKinds(problems []integrityProblem) string {
+
+	counts := make(map[string]int)
+	kinds := []string{}
+	for _, p := range problems {
+		if counts[p.Kind] == 0 {
+			kinds = append(kinds, p.Kind)
+		}
+		counts[p.Kind]++
+	}
+	sort.Strings(kinds)
+
+	message := "<ul>"
+	for _, kind := range kinds {
+		wording, ok := integrityProblemWording[kind]
+		if !ok {
+			wording = "%d " + kind + "."
+		}
+		message += "<li>" + fmt.Sprintf(wording, counts[kind]) + "</li>"
+	}
+	message += "</ul>"
+
+	return message
+}
+
+func (p integrityProblem) key() string {
+	return p.Ticket + "~" + p.Asset + "~" + p.Kind
+}
+
+// the problems still open in an environment, by key.
+func getOpenIntegrityProblems(environment string) map[string]integrityProblem {
+
+	open := make(map[string]integrityProblem)
+
+	rows, err := db.Query(`SELECT ticket, asset, kind, path, firstseen FROM public.integrityproblem
+		WHERE environment = $1 and resolved is null`, environment)
+	if err != nil {
+		log.Println(err.Error())
+		return open
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := integrityProblem{}
+		if err = rows.Scan(&p.Ticket, &p.Asset, &p.Kind, &p.Path, &p.FirstSeen); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		open[p.key()] = p
+	}
+
+	return open
+}
+
+// the problems new since the last run, as html for the integrity notification.
+func formatNewIntegrityProblems(problems []integrityProblem) string {
+
+	if len(problems) == 0 {
+		return ""
+	}
+
+	const shown = 20
+
+	message := fmt.Sprintf("<p>%d new since the last check:</p><ul>", len(problems))
+	for i, p := range problems {
+		if i == shown {
+			message += fmt.Sprintf("<li>and %d more</li>", len(problems)-shown)
+			break
+		}
+		message += fmt.Sprintf("<li>%s / %s - %s</li>", html.EscapeString(p.Ticket), html.EscapeString(p.Asset), p.Kind)
+	}
+	message += "</ul>"
+
+	return message
+}
+
+// the history page: open problems over time for each environment, then every problem still open
+// or resolved within the chart's period.
+func getIntegrityHistory(report *string) bool {
+
+	since := time.Now().AddDate(0, 0, -cINTEGRITYHISTORYDAYS)
+
+	rows, err := db.Query(`SELECT environment, started, problems FROM public.integrityrun
+		WHERE started >= $1 and complete
+		ORDER BY environment, started`, since)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	defer rows.Close()
+
+	trends := make(map[string][]trendPoint)
+	environments := []string{}
+
+	for rows.Next() {
+		environment := ""
+		point := trendPoint{}
+		if err = rows.Scan(&environment, &point.when, &point.value); err != nil {
+			log.Println(err.Error())
+			return false
+		}
+		if _, ok := trends[environment]; !ok {
+			environments = append(environments, environment)
+		}
+		trends[environment] = append(trends[environment], point)
+	}
+	rows.Close()
+
+	tabledef := ""
+	tableheader := ""
+	tablebody := ""
+
+	log.Println("DAMInform.getIntegrityHistory() ....")
+
+	tableheader += "<h1>Integrity check history</h1>"
+	for _, environment := range environments {
+		points := trends[environment]
+		tableheader += fmt.Sprintf("<h3>%s</h3><p>%d open problems at the last check.</p>",
+			html.EscapeString(environment), points[len(points)-1].value)
+		tableheader += svgTrendChart(points, 720, 160)
+	}
+
+	tableheader += "<thead><tr>"
+	tableheader += "<th>Environment</th><th>Ticket</th><th>Asset</th><th>Problem</th><th>First seen</th><th>Last seen</th><th>Open for</th><th>Resolved</th>"
+	tableheader += "</tr></thead>"
+	tablebody += "<tbody>"
+
+	rows, err = db.Query(`SELECT environment, ticket, asset, kind, firstseen, lastseen, resolved
+		FROM public.integrityproblem
+		WHERE resolved is null or resolved >= $1
+		ORDER BY resolved is not null, environment, firstseen, ticket, asset`, since)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		environment := ""
+		p := integrityProblem{}
+		var lastseen time.Time
+		var resolved pq.NullTime
+
+		err = rows.Scan(
+			&environment,
+			&p.Ticket,
+			&p.Asset,
+			&p.Kind,
+			&p.FirstSeen,
+			&lastseen,
+			&resolved,
+		)
+		if err != nil {
+			log.Println(err.Error())
+			return false
+		}
+
+		until := time.Now()
+		if resolved.Valid {
+			until = resolved.Time
+		}
+
+		tablebody += "<tr>"
+		tablebody += fmt.Sprintf("<th class='row-header'>%s</th>", html.EscapeString(environment))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(p.Ticket))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(p.Asset))
+		tablebody += fmt.Sprintf("<td>%s</td>", p.Kind)
+		tablebody += fmt.Sprintf("<td>%s</td>", p.FirstSeen.Format("2006-01-02 15:04"))
+		tablebody += fmt.Sprintf("<td>%s</td>", lastseen.Format("2006-01-02 15:04"))
+		tablebody += fmt.Sprintf("<td>%s</td>", formatOpenFor(until.Sub(p.FirstSeen)))
+		tablebody += fmt.Sprintf("<td>%s</td>", formatNullTime(resolved))
+		tablebody += "</tr>"
+	}
+
+	tablebody += "</tbody>"
+
+	tabledef = tableheader + tablebody
+
+	overlaptemplate, _ := readlines2("html/reporttemplate.html")
+
+	var line string
+	for i := range overlaptemplate {
+		line = overlaptemplate[i]
+		line = strings.Replace(line, "<cdata>%%TABLE%%</cdata>", tabledef, -1)
+		*report += line
+	}
+
+	return true
+}
+
+// e.g. "3 days", "5 hours"
+func formatOpenFor(d time.Duration) string {
+
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	case d >= 2*time.Hour:
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	}
+}
+
+type trendPoint struct {
+	when  time.Time
+	value int
+}
+
+// a line chart of values over time, as inline svg.
+func svgTrendChart(points []trendPoint, width, height int) string {
+
+	const margin = 30
+
+	if len(points) == 0 {
+		return ""
+	}
+
+	first := points[0].when
+	span := points[len(points)-1].when.Sub(first).Seconds()
+	if span <= 0 {
+		span = 1
+	}
+	top := 1
+	for _, p := range points {
+		if p.value > top {
+			top = p.value
+		}
+	}
+
+	x := func(t time.Time) float64 {
+		return margin + t.Sub(first).Seconds()/span*float64(width-2*margin)
+	}
+	y := func(v int) float64 {
+		return float64(height-margin) - float64(v)/float64(top)*float64(height-2*margin)
+	}
+
+	coords := []string{}
+	for _, p := range points {
+		coords = append(coords, fmt.Sprintf("%.1f,%.1f", x(p.when), y(p.value)))
+	}
+
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" style="font-family: Lato, Arial, sans-serif; font-size: 11px;">`, width, height)
+	svg += fmt.Sprintf(`<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#ccc"/>`, margin, height-margin, width-margin, height-margin)
+	svg += fmt.Sprintf(`<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#ccc"/>`, margin, margin, margin, height-margin)
+	svg += fmt.Sprintf(`<text x="%d" y="%d" text-anchor="end">%d</text>`, margin-4, margin+4, top)
+	svg += fmt.Sprintf(`<text x="%d" y="%d" text-anchor="end">0</text>`, margin-4, height-margin+4)
+	svg += fmt.Sprintf(`<text x="%d" y="%d">%s</text>`, margin, height-margin+16, first.Format("Jan _2"))
+	svg += fmt.Sprintf(`<text x="%d" y="%d" text-anchor="end">%s</text>`, width-margin, height-margin+16, points[len(points)-1].when.Format("Jan _2"))
+	svg += fmt.Sprintf(`<polyline fill="none" stroke="#a94442" stroke-width="2" points="%s"/>`, strings.Join(coords, " "))
+	svg += "</svg>"
+
+	return svg
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIntegrityResultLooksFor(t *testing.T) {
+
+	for _, c := range []struct {
+		deep      bool
+		templates bool
+		kind      string
+		want      bool
+	}{
+		{false, false, cPROBLEMMISSINGDAMASSET, true},
+		{false, false, cPROBLEMMISSINGFILESYSTEM, true},
+		{false, false, cPROBLEMMALFORMEDTEMPLATE, false},
+		{false, false, cPROBLEMCONTENTDRIFT, false},
+
+		// the nightly check reads templates, so it resolves template problems but not drift
+		{false, true, cPROBLEMMALFORMEDTEMPLATE, true},
+		{false, true, cPROBLEMTEMPLATEMISMATCH, true},
+		{false, true, cPROBLEMCONTENTDRIFT, false},
+
+		{true, true, cPROBLEMCONTENTDRIFT, true},
+		{true, true, cPROBLEMTEMPLATEMISMATCH, true},
+		{true, true, cPROBLEMMISSINGDAMASSET, true},
+	} {
+		result := integrityResult{Deep: c.deep, TemplatesChecked: c.templates}
+		if got := result.looksFor(c.kind); got != c.want {
+			t.Errorf("deep %v, templates %v: looksFor(%q) = %v, want %v", c.deep, c.templates, c.kind, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Notification and Dashboard Service for DAM
+//
+// instant dispatch: a trigger on notificationqueue NOTIFYs on insert, and DAMInform LISTENs and dispatches
+// within seconds. the scheduled dispatch job stays as the fallback.
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/lib/pq" // golang postgres db driver
+)
+
+// the channel the notificationqueue trigger notifies, see schema.go
+const cNOTIFYCHANNEL = "daminform_notificationqueue"
+
+// how long to wait after a notify for others to follow, so a burst of inserts makes one dispatch
+const cLISTENSETTLE = 2 * time.Second
+
+// the listener connection is pinged this often, to notice a dead connection that reported nothing
+const cLISTENPING = 90 * time.Second
+
+// listens for new notifications and runs the dispatch job for them; pq.Listener reconnects by itself.
+func startListener() {
+
+	listener := pq.NewListener(dbConnInfo(), 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnected:
+			log.Println("DAMInform listener: listening on " + cNOTIFYCHANNEL)
+		case pq.ListenerEventDisconnected:
+			logMessage("Listener: connection lost, dispatch falls back to polling until it is back : "+err.Error(), "", "ERROR")
+		case pq.ListenerEventReconnected:
+			logMessage("Listener: reconnected", "", "INFO")
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Println("DAMInform listener: reconnect failed: " + err.Error())
+		}
+	})
+
+	if err := listener.Listen(cNOTIFYCHANNEL); err != nil {
+		logMessage("Listener: unable to listen on "+cNOTIFYCHANNEL+" : "+err.Error(), "", "ERROR")
+		listener.Close()
+		return
+	}
+
+	go listen(listener)
+}
+
+func listen(listener *pq.Listener) {
+
+	var settle <-chan time.Time
+
+	for {
+		select {
+		case <-listener.Notify:
+			// nil after a reconnect, when inserts may have been missed: dispatch then as well
+			if settle == nil {
+				settle = time.After(cLISTENSETTLE)
+			}
+
+		case <-settle:
+			settle = nil
+			err := runJob("dispatch", "listen")
+			if err == errJobRunning {
+				// the run under way may have read the queue before the new rows went in
+				settle = time.After(cLISTENSETTLE)
+			} else if err != nil {
+				log.Println("DAMInform listener: dispatch: " + err.Error())
+			}
+
+		case <-time.After(cLISTENPING):
+			go listener.Ping()
+		}
+	}
+}
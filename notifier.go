@@ -0,0 +1,300 @@
+// Notification and Dashboard Service for DAM
+//
+// notification channels: smtp, json webhook and a local maildir sink, chosen per notification by config routes
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/gomail.v2" // outbound email support
+)
+
+// channel types understood in config.Channels
+const (
+	cCHANNELSMTP    = "smtp"
+	cCHANNELWEBHOOK = "webhook"
+	cCHANNELFILE    = "file"
+)
+
+// a composed notification, ready to hand to any channel
+type outboundMessage struct {
+	NotificationID int          `json:"id"`
+	To             []string     `json:"to"`
+	Cc             []string     `json:"cc"`
+	Subject        string       `json:"subject"`
+	HTML           string       `json:"html"`
+	Text           string       `json:"text"`
+	JiraKey        string       `json:"jirakey"`
+	Asset          string       `json:"asset"`
+	Lead           string       `json:"lead"`
+	NotifyMgr      bool         `json:"notifymgr"`
+	Created        time.Time    `json:"created"`
+	Severity       string       `json:"severity"`
+	Inline         []string     `json:"-"` // files embedded in the html, referenced as cid:<filename>
+	Attachments    []attachment `json:"-"`
+}
+
+// Notifier delivers a message on one channel.
+type Notifier interface {
+	Name() string
+	Notify(msg outboundMessage) error
+}
+
+// a channel as declared in config.json
+type channelConfig struct {
+	Name string
+	Type string // smtp, webhook or file
+	URL  string // webhook: where the JSON document is POSTed
+	Path string // file: maildir the messages are written to
+}
+
+// picks channels for the notifications it matches; empty criteria match everything.
+type routeConfig struct {
+	JiraKeyPrefix   string
+	AssetSuffix     string
+	MessageContains string
+	NotifyMgr       *bool
+	Channels        []string
+}
+
+var notifiers = make(map[string]Notifier)
+
+// builds the configured channels. an "smtp" channel always exists so that older config files keep working.
+func initNotifiers() {
+
+	for _, c := range sessionConfig.Channels {
+
+		var n Notifier
+
+		switch strings.ToLower(c.Type) {
+		case cCHANNELSMTP:
+			n = &smtpNotifier{name: c.Name}
+		case cCHANNELWEBHOOK:
+			if c.URL == "" {
+				logMessage("Notifier: webhook channel "+c.Name+" has no URL", "", "ERROR")
+				continue
+			}
+			n = &webhookNotifier{name: c.Name, url: c.URL, client: &http.Client{Timeout: 30 * time.Second}}
+		case cCHANNELFILE:
+			if c.Path == "" {
+				logMessage("Notifier: file channel "+c.Name+" has no Path", "", "ERROR")
+				continue
+			}
+			n = &fileNotifier{name: c.Name, path: c.Path}
+		default:
+			logMessage("Notifier: unknown channel type "+c.Type+" for "+c.Name, "", "ERROR")
+			continue
+		}
+
+		notifiers[c.Name] = n
+	}
+
+	if _, ok := notifiers[cCHANNELSMTP]; !ok {
+		notifiers[cCHANNELSMTP] = &smtpNotifier{name: cCHANNELSMTP}
+	}
+}
+
+// the channels a notification should go out on: every channel of every matching route,
+// or config.DefaultChannels when no route matches.
+func routeNotification(n queuedNotification) []string {
+
+	channels := []string{}
+	seen := make(map[string]bool)
+
+	for _, route := range sessionConfig.Routes {
+		if !route.matches(n) {
+			continue
+		}
+		for _, c := range route.Channels {
+			if !seen[c] {
+				seen[c] = true
+				channels = append(channels, c)
+			}
+		}
+	}
+
+	if len(channels) == 0 {
+		channels = sessionConfig.DefaultChannels
+	}
+	if len(channels) == 0 {
+		channels = []string{cCHANNELSMTP}
+	}
+
+	return channels
+}
+
+func (route routeConfig) matches(n queuedNotification) bool {
+
+	if route.JiraKeyPrefix != "" && !strings.HasPrefix(n.JiraKey, route.JiraKeyPrefix) {
+		return false
+	}
+	if route.AssetSuffix != "" && !strings.HasSuffix(n.Asset, route.AssetSuffix) {
+		return false
+	}
+	if route.MessageContains != "" && !strings.Contains(strings.ToLower(n.Message), strings.ToLower(route.MessageContains)) {
+		return false
+	}
+	if route.NotifyMgr != nil && *route.NotifyMgr != n.NotifyMgr {
+		return false
+	}
+
+	return true
+}
+
+// ---------------------------------------------------------------- smtp
+
+type smtpNotifier struct {
+	name string
+}
+
+func (s *smtpNotifier) Name() string { return s.name }
+
+func (s *smtpNotifier) Notify(msg outboundMessage) error {
+
+	if len(msg.To)+len(msg.Cc) == 0 {
+		return errors.New("no recipients")
+	}
+
+	return sendSMTP(buildMailMessage(msg))
+}
+
+// the email form of a message, shared by the smtp and file channels.
+func buildMailMessage(msg outboundMessage) *gomail.Message {
+
+	m := gomail.NewMessage()
+	m.SetAddressHeader("From", sessionConfig.SenderAddress, sessionConfig.SenderName)
+	if len(msg.To) > 0 {
+		m.SetHeader("To", msg.To...)
+	}
+	if len(msg.Cc) > 0 {
+		m.SetHeader("Cc", msg.Cc...)
+	}
+	m.SetHeader("Subject", msg.Subject)
+	if msg.Severity == cSEVERITYHIGH {
+		m.SetHeader("Importance", "high")
+		m.SetHeader("X-Priority", "1")
+	}
+
+	if msg.Text != "" {
+		m.SetBody("text/plain", msg.Text)
+		m.AddAlternative("text/html", msg.HTML)
+	} else {
+		m.SetBody("text/html", msg.HTML)
+	}
+
+	for _, inline := range msg.Inline {
+		if _, err := os.Stat(inline); err == nil {
+			m.Embed(inline)
+		}
+	}
+
+	for _, a := range msg.Attachments {
+		content := a.Content
+		m.Attach(a.Name,
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(content)
+				return err
+			}),
+			gomail.SetHeader(map[string][]string{"Content-Type": {a.Type}}))
+	}
+
+	return m
+}
+
+// ---------------------------------------------------------------- webhook
+
+// POSTs the message as JSON, for the chat channel bridges.
+type webhookNotifier struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+func (wh *webhookNotifier) Name() string { return wh.name }
+
+func (wh *webhookNotifier) Notify(msg outboundMessage) error {
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	resp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s replied %s", wh.name, resp.Status)
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------- file
+
+// writes each message as an .eml file into a maildir, for environments without a mail relay.
+type fileNotifier struct {
+	name string
+	path string
+}
+
+func (f *fileNotifier) Name() string { return f.name }
+
+func (f *fileNotifier) Notify(msg outboundMessage) error {
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(f.path, sub), 0755); err != nil {
+			return err
+		}
+	}
+
+	// maildir delivery: write under tmp/ then move into new/ so readers never see a partial file
+	hostname, _ := os.Hostname()
+	filename := fmt.Sprintf("%d.%d_%d.%s.eml", time.Now().Unix(), time.Now().UnixNano(), msg.NotificationID, hostname)
+	tmppath := filepath.Join(f.path, "tmp", filename)
+
+	file, err := os.Create(tmppath)
+	if err != nil {
+		return err
+	}
+
+	_, err = buildMailMessage(msg).WriteTo(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+
+	log.Println("DAMInform: notification " + filename + " written to " + f.path)
+
+	return os.Rename(tmppath, filepath.Join(f.path, "new", filename))
+}
+
+var reHTMLTAG = regexp.MustCompile(`<[^>]*>`)
+
+// a rough plain-text rendering of an html notification, for channels that can't show html.
+func htmlToText(html string) string {
+
+	text := strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n", "</p>", "\n", "</tr>", "\n", "</li>", "\n",
+		"</h2>", "\n\n", "</h3>", "\n", "</h4>", "\n", "<li>", "  - ").Replace(html)
+	text = reHTMLTAG.ReplaceAllString(text, "")
+	text = strings.NewReplacer("&nbsp;", " ", "&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", `"`, "&#39;", "'").Replace(text)
+
+	return strings.TrimSpace(text)
+}
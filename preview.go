@@ -0,0 +1,118 @@
+// Notification and Dashboard Service for DAM
+//
+// dispatch preview: what doDispatch() would send, without sending it or touching delivery state
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+)
+
+// plans every notification waiting to go out, including failed ones still backing off.
+func doPreview() ([]dispatchPlan, bool) {
+
+	log.Println("DAMInform.doPreview() ....")
+
+	// far enough ahead that every retry counts as due
+	pending, ok := getDueNotifications(time.Now().Add(100 * 365 * 24 * time.Hour))
+	if !ok {
+		return nil, false
+	}
+
+	plans := []dispatchPlan{}
+	for _, n := range pending {
+		plans = append(plans, planNotification(n))
+	}
+
+	return plans, true
+}
+
+func getPreviewJSON(report *string) bool {
+
+	plans, ok := doPreview()
+	if !ok {
+		return false
+	}
+
+	content, err := json.MarshalIndent(plans, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+
+	*report += string(content)
+
+	return true
+}
+
+func getPreview(report *string) bool {
+
+	plans, ok := doPreview()
+	if !ok {
+		return false
+	}
+
+	tabledef := ""
+	tableheader := ""
+	tablebody := ""
+
+	tableheader += fmt.Sprintf("<h1>Dispatch preview - %d notifications, nothing has been sent</h1><thead><tr>", len(plans))
+	for _, title := range []string{"Id", "To", "Cc", "Digest", "Channels", "Subject", "Body", "Text"} {
+		tableheader += fmt.Sprintf("<th>%s</th>", title)
+	}
+	tableheader += "</tr></thead>"
+	tablebody += "<tbody>"
+
+	for _, plan := range plans {
+
+		if plan.Suppressed {
+			tablebody += "<tr>"
+			tablebody += fmt.Sprintf("<th class='row-header'> %d </th>", plan.Notification.ID)
+			tablebody += fmt.Sprintf("<td colspan='7'>duplicate of %s / %s / %s to %s, will be suppressed</td>",
+				plan.Notification.Kind, plan.Notification.JiraKey, plan.Notification.Asset, html.EscapeString(strings.Join(plan.Duplicates, ", ")))
+			tablebody += "</tr>"
+			continue
+		}
+
+		channels := strings.Join(plan.Channels, ", ")
+		if len(plan.Delivered) > 0 {
+			channels += " (already sent on " + strings.Join(plan.Delivered, ", ") + ")"
+		}
+
+		to := html.EscapeString(strings.Join(plan.Message.To, ", "))
+		if len(plan.Duplicates) > 0 {
+			to += " (not again: " + html.EscapeString(strings.Join(plan.Duplicates, ", ")) + ")"
+		}
+
+		tablebody += "<tr>"
+		tablebody += fmt.Sprintf("<th class='row-header'> %d </th>", plan.Notification.ID)
+		tablebody += fmt.Sprintf("<td>%s</td>", to)
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(strings.Join(plan.Message.Cc, ", ")))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(strings.Join(plan.Digest, ", ")))
+		tablebody += fmt.Sprintf("<td>%s</td>", channels)
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(plan.Message.Subject))
+		tablebody += fmt.Sprintf("<td><iframe style='width: 40em; height: 20em; border: 1px solid #ccc;' srcdoc=\"%s\"></iframe></td>", html.EscapeString(plan.Message.HTML))
+		tablebody += fmt.Sprintf("<td><pre>%s</pre></td>", html.EscapeString(plan.Message.Text))
+		tablebody += "</tr>"
+	}
+
+	tablebody += "</tbody>"
+
+	tabledef = tableheader + tablebody
+
+	overlaptemplate, _ := readlines2("html/reporttemplate.html")
+
+	var line string
+	for i := range overlaptemplate {
+		line = overlaptemplate[i]
+		line = strings.Replace(line, "<cdata>%%TABLE%%</cdata>", tabledef, -1)
+		*report += line
+	}
+
+	return true
+}
@@ -0,0 +1,457 @@
+// Notification and Dashboard Service for DAM
+//
+// repair planner: works out what would bring damasset and a ticket's folder back in line - register files
+// damasset is missing, remove rows for files that are gone, follow renames - shows the plan, and applies it
+// only when the plan that was shown is confirmed. every action applied is recorded in repairaudit.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq" // golang postgres db driver
+)
+
+// repairAction.Action values
+const (
+	cREPAIRREGISTER = "register" // on disk, not in damasset: have DAMLogger pick it up
+	cREPAIRREMOVE   = "remove"   // in damasset, gone from disk: delete the row
+	cREPAIRRENAME   = "rename"   // a tracked file now on disk under another name: point the row at it
+)
+
+// one proposed change
+type repairAction struct {
+	Action string `json:"action"`
+	Ticket string `json:"ticket"`
+	Asset  string `json:"asset"`          // the filename as it is, or was for removals
+	From   string `json:"from,omitempty"` // rename: the filename damasset has
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+type repairPlan struct {
+	Ticket  string         `json:"ticket"`
+	Actions []repairAction `json:"actions"`
+	Token   string         `json:"token"` // confirms exactly this plan, see applyRepairPlan()
+}
+
+var errRepairPlanChanged = errors.New("the plan has changed since it was shown, review it again")
+
+// works out the actions for a ticket, changing nothing. renames are recognised by content:
+// an untracked file with the sha256 a deep integrity check recorded for a missing one.
+func planRepair(ctx context.Context, ticket string) (repairPlan, error) {
+
+	plan := repairPlan{Ticket: ticket, Actions: []repairAction{}}
+
+	if ticket == "" || strings.ContainsAny(ticket, `/\`) || ticket == "." || ticket == ".." {
+		return plan, fmt.Errorf("%q is not a ticket folder", ticket)
+	}
+
+	tracked, err := getTicketAssets(ticket)
+	if err != nil {
+		return plan, err
+	}
+	fingerprints, _ := getAssetFingerprints()
+
+	if err = planTicketRepair(ctx, &plan, tracked, fingerprints); err != nil {
+		return plan, err
+	}
+
+	plan.Token = repairToken(plan)
+
+	return plan, nil
+}
+
+// the damasset rows for a ticket, by filename.
+func getTicketAssets(ticket string) (map[string]damassetRow, error) {
+
+	tracked := make(map[string]damassetRow)
+
+	rows, err := db.Query(`SELECT folder, filename, fullfilepath, coalesce(resourcemainid, ''), coalesce(modified, false), coalesce(islatest, false)
+		FROM public.damasset WHERE upper(folder) = upper($1)`, ticket)
+	if err != nil {
+		log.Println(err.Error())
+		return tracked, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := damassetRow{}
+		if err = rows.Scan(&row.Folder, &row.Filename, &row.FullFilePath, &row.ResourceMainID, &row.Modified, &row.IsLatest); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		tracked[row.Filename] = row
+	}
+
+	return tracked, nil
+}
+
+// walks the ticket's folder against its damasset rows, tracked, and adds the actions to plan, sorted.
+// fingerprints are the ones deep checks recorded, by folder~filename, which is how renames are recognised.
+func planTicketRepair(ctx context.Context, plan *repairPlan, tracked map[string]damassetRow, fingerprints map[string]assetFingerprint) error {
+
+	ticket := plan.Ticket
+	ticketPath := filepath.Join(sessionConfig.ChangesetPath, ticket)
+
+	untracked := make(map[string]string) // file name -> path, for files damasset should have
+
+	err := walkChangesets(ctx, "repair "+ticket, ticketPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != ticketPath && ignoredFolder(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relpath, err := filepath.Rel(ticketPath, path)
+		if err != nil {
+			return err
+		}
+		t, ok := assetTypeOf(relpath)
+		if !ok {
+			return nil
+		}
+		asset := filepath.Base(path)
+		filename, ok := t.damassetFilename(asset)
+		if !ok {
+			return nil
+		}
+		if _, ok := tracked[filename]; ok {
+			delete(tracked, filename)
+		} else {
+			untracked[asset] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// what's left in tracked is gone from disk; look for it under another name before removing it
+	bysha := make(map[string]string)
+	for asset, path := range untracked {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if f, err := fingerprintFile(path, info); err == nil {
+			bysha[f.SHA256] = asset
+		}
+	}
+
+	for _, row := range tracked {
+		if f, ok := fingerprints[row.Folder+"~"+row.Filename]; ok {
+			if asset, ok := bysha[f.SHA256]; ok {
+				plan.Actions = append(plan.Actions, repairAction{Action: cREPAIRRENAME, Ticket: ticket, Asset: asset, From: row.Filename,
+					Path: untracked[asset], Reason: "same content as " + row.Filename + ", which is gone"})
+				delete(untracked, asset)
+				delete(bysha, f.SHA256)
+				continue
+			}
+		}
+		plan.Actions = append(plan.Actions, repairAction{Action: cREPAIRREMOVE, Ticket: ticket, Asset: row.Filename,
+			Path: row.FullFilePath, Reason: cPROBLEMMISSINGFILESYSTEM})
+	}
+
+	for asset, path := range untracked {
+		plan.Actions = append(plan.Actions, repairAction{Action: cREPAIRREGISTER, Ticket: ticket, Asset: asset,
+			Path: path, Reason: cPROBLEMMISSINGDAMASSET})
+	}
+
+	sort.Slice(plan.Actions, func(i, j int) bool {
+		if plan.Actions[i].Action != plan.Actions[j].Action {
+			return plan.Actions[i].Action < plan.Actions[j].Action
+		}
+		return plan.Actions[i].Asset < plan.Actions[j].Asset
+	})
+
+	return nil
+}
+
+// signs the actions, so that what is applied is what was reviewed.
+func repairToken(plan repairPlan) string {
+
+	content, _ := json.Marshal(plan.Actions)
+
+	mac := hmac.New(sha256.New, ackSecret)
+	mac.Write([]byte("repair:" + plan.Ticket + ":"))
+	mac.Write(content)
+
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// plans again and applies the plan if it is still the one token was issued for, as a confirmed page must.
+func applyRepairPlan(ctx context.Context, ticket, token, by string) (repairPlan, int, error) {
+
+	plan, err := planRepair(ctx, ticket)
+	if err != nil {
+		return plan, 0, err
+	}
+	if !hmac.Equal([]byte(token), []byte(plan.Token)) {
+		return plan, 0, errRepairPlanChanged
+	}
+
+	return plan, applyRepairActions(plan, by), nil
+}
+
+// applies a plan's actions one by one, each recorded in repairaudit whatever its outcome. returns how many failed.
+func applyRepairActions(plan repairPlan, by string) int {
+
+	failed := 0
+
+	for _, action := range plan.Actions {
+
+		err := applyRepairAction(action)
+		if err != nil {
+			failed++
+		}
+		recordRepairAudit(action, by, err)
+	}
+
+	return failed
+}
+
+func applyRepairAction(action repairAction) error {
+
+	var err error
+
+	switch action.Action {
+	case cREPAIRREGISTER:
+		// as DAMLogger records a change, so it registers the file itself
+		_, err = db.Exec(`INSERT INTO public.activity_local
+			(filename, operation, directory, "time", optime)
+			VALUES($1, $2, $3, 0, $4);`, action.Asset, "MODIFY", filepath.Dir(action.Path), time.Now())
+
+	case cREPAIRREMOVE:
+		_, err = db.Exec(`DELETE FROM public.damasset WHERE upper(folder) = upper($1) and filename = $2`, action.Ticket, action.Asset)
+		if err == nil {
+			_, err = db.Exec(`DELETE FROM public.assetfingerprint WHERE upper(folder) = upper($1) and filename = $2`, action.Ticket, action.Asset)
+		}
+
+	case cREPAIRRENAME:
+		// the row's filename follows the new file, in the form its type keeps in damasset
+		filename := action.Asset
+		if t, ok := assetTypeOf(action.Asset); ok {
+			filename, _ = t.damassetFilename(action.Asset)
+		}
+		_, err = db.Exec(`UPDATE public.damasset SET filename = $1, fullfilepath = $2
+			WHERE upper(folder) = upper($3) and filename = $4`, filename, action.Path, action.Ticket, action.From)
+		if err == nil {
+			_, err = db.Exec(`UPDATE public.assetfingerprint SET filename = $1
+				WHERE upper(folder) = upper($2) and filename = $3`, filename, action.Ticket, action.From)
+		}
+
+	default:
+		err = fmt.Errorf("unknown repair action %s", action.Action)
+	}
+
+	if err, ok := err.(*pq.Error); ok {
+		fmt.Println("pq error:", err.Code.Name())
+		logMessage("REPAIR: "+action.Action+" "+action.Asset+" failed : "+err.Code.Name()+" - "+err.Message, action.Ticket, "ERROR")
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	logMessage("REPAIR: "+action.Action+" "+action.Asset, action.Ticket, "INFO")
+
+	return nil
+}
+
+func recordRepairAudit(action repairAction, by string, applyErr error) {
+
+	outcome := "ok"
+	detail := ""
+	if applyErr != nil {
+		outcome = "failed"
+		detail = applyErr.Error()
+	}
+
+	_, err := db.Exec(`INSERT INTO public.repairaudit
+		(ticket, action, asset, fromasset, path, reason, outcome, detail, appliedby, applied)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		action.Ticket, action.Action, action.Asset, action.From, action.Path, action.Reason, outcome, detail, by, time.Now())
+	if err, ok := err.(*pq.Error); ok {
+		fmt.Println("pq error:", err.Code.Name())
+		logMessage("Problems recording repair audit : "+err.Code.Name(), action.Ticket, "ERROR")
+	}
+}
+
+// the repair pages:
+//
+//	GET  /Repair,<ticket>[,json]  the plan, as a page or json; nothing is changed
+//	POST /Repair,<ticket>         applies the plan, with the token from the page (admin)
+func handleRepair(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(strings.Trim(r.URL.Path, "/"), ",")
+	if len(params) < 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ticket := strings.Trim(params[1], "/")
+
+	// the form posts back here, carrying the admin token the page was opened with
+	formaction := environmentPath("/Repair," + ticket)
+	if token := r.URL.Query().Get("token"); token != "" {
+		formaction += "?token=" + url.QueryEscape(token)
+	}
+
+	report := ""
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+
+		if !isAdmin(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		plan, failed, err := applyRepairPlan(r.Context(), ticket, r.FormValue("confirm"), clientAddress(r))
+		if err == errRepairPlanChanged {
+			w.WriteHeader(http.StatusConflict)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		message := fmt.Sprintf("%d actions applied, %d failed.", len(plan.Actions)-failed, failed)
+		if err != nil {
+			message = err.Error()
+		}
+		if getRepairPage(r.Context(), &report, ticket, formaction, message) {
+			fmt.Fprint(w, report)
+		}
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(params) > 2 && strings.ToLower(strings.Trim(params[2], "/")) == "json" {
+		plan, err := planRepair(r.Context(), ticket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plan)
+		return
+	}
+
+	if getRepairPage(r.Context(), &report, ticket, formaction, "") {
+		fmt.Fprint(w, report)
+	}
+}
+
+// the dry run: the plan for a ticket with a button to apply it, then what has been applied before.
+func getRepairPage(ctx context.Context, report *string, ticket, formaction, message string) bool {
+
+	plan, err := planRepair(ctx, ticket)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+
+	tabledef := ""
+	tableheader := ""
+	tablebody := ""
+
+	log.Println("DAMInform.getRepairPage() ....")
+
+	tableheader += fmt.Sprintf("<h1>Repair plan - %s</h1>", html.EscapeString(ticket))
+	if message != "" {
+		tableheader += fmt.Sprintf("<p><b>%s</b></p>", html.EscapeString(message))
+	}
+	if len(plan.Actions) == 0 {
+		tableheader += "<p>damasset and the ticket folder agree, there is nothing to repair.</p>"
+	} else {
+		tableheader += fmt.Sprintf(`<form method="post" action="%s">
+			<input type="hidden" name="confirm" value="%s">
+			<button type="submit">Apply these %d actions</button>
+			</form>`, html.EscapeString(formaction), plan.Token, len(plan.Actions))
+	}
+
+	tableheader += "<thead><tr>"
+	tableheader += "<th>Action</th><th>Asset</th><th>From</th><th>Path</th><th>Why</th><th>Applied</th><th>Outcome</th>"
+	tableheader += "</tr></thead>"
+	tablebody += "<tbody>"
+
+	for _, action := range plan.Actions {
+		tablebody += "<tr>"
+		tablebody += fmt.Sprintf("<th class='row-header'>%s</th>", action.Action)
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(action.Asset))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(action.From))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(action.Path))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(action.Reason))
+		tablebody += "<td>proposed</td><td></td>"
+		tablebody += "</tr>"
+	}
+
+	rows, err := db.Query(`SELECT action, asset, fromasset, path, reason, applied, outcome, detail, appliedby
+		FROM public.repairaudit WHERE upper(ticket) = upper($1)
+		ORDER BY applied desc LIMIT 100`, ticket)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a := repairAction{}
+		var applied time.Time
+		outcome := ""
+		detail := ""
+		by := ""
+
+		err = rows.Scan(&a.Action, &a.Asset, &a.From, &a.Path, &a.Reason, &applied, &outcome, &detail, &by)
+		if err != nil {
+			log.Println(err.Error())
+			return false
+		}
+
+		tablebody += "<tr style='color: #777;'>"
+		tablebody += fmt.Sprintf("<th class='row-header'>%s</th>", a.Action)
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(a.Asset))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(a.From))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(a.Path))
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(a.Reason))
+		tablebody += fmt.Sprintf("<td>%s by %s</td>", applied.Format("2006-01-02 15:04:05"), html.EscapeString(by))
+		tablebody += fmt.Sprintf("<td>%s %s</td>", outcome, html.EscapeString(detail))
+		tablebody += "</tr>"
+	}
+
+	tablebody += "</tbody>"
+
+	tabledef = tableheader + tablebody
+
+	overlaptemplate, _ := readlines2("html/reporttemplate.html")
+
+	var line string
+	for i := range overlaptemplate {
+		line = overlaptemplate[i]
+		line = strings.Replace(line, "<cdata>%%TABLE%%</cdata>", tabledef, -1)
+		*report += line
+	}
+
+	return true
+}
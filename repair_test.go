@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// a ticket folder holding files, with the changeset repository pointed at it; returns the folder's path.
+func writeTestTicket(t *testing.T, ticket string, files map[string]string) string {
+
+	t.Helper()
+
+	root := t.TempDir()
+	useAssetTypes(t)
+	sessionConfig.ChangesetPath = root
+	sessionConfig.WalkWorkers = 2
+
+	for name, content := range files {
+		path := filepath.Join(root, ticket, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return filepath.Join(root, ticket)
+}
+
+func TestPlanTicketRepair(t *testing.T) {
+
+	ticketPath := writeTestTicket(t, "CSDFK-1234", map[string]string{
+		"Sepsis.oet":           "<template>sepsis</template>",
+		"Sepsis Screening.oet": "<template>screening</template>", // Screening.oet renamed
+		"Falls.oet":            "<template>falls</template>",     // new
+		"downloads/Old.oet":    "<template>old</template>",       // ignored, never registered
+		"notes.txt":            "not an asset",
+	})
+
+	tracked := map[string]damassetRow{
+		"Sepsis.oet":    {Folder: "CSDFK-1234", Filename: "Sepsis.oet"},
+		"Screening.oet": {Folder: "CSDFK-1234", Filename: "Screening.oet"},
+		"NEWS2.oet":     {Folder: "CSDFK-1234", Filename: "NEWS2.oet", FullFilePath: "CSDFK-1234/NEWS2.oet"}, // deleted
+	}
+
+	path := filepath.Join(ticketPath, "Sepsis Screening.oet")
+	info, _ := os.Stat(path)
+	screening, err := fingerprintFile(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprints := map[string]assetFingerprint{"CSDFK-1234~Screening.oet": screening}
+
+	plan := repairPlan{Ticket: "CSDFK-1234"}
+	if err := planTicketRepair(context.Background(), &plan, tracked, fingerprints); err != nil {
+		t.Fatalf("planTicketRepair: %v", err)
+	}
+
+	want := []repairAction{
+		{Action: cREPAIRREGISTER, Ticket: "CSDFK-1234", Asset: "Falls.oet", Path: filepath.Join(ticketPath, "Falls.oet"), Reason: cPROBLEMMISSINGDAMASSET},
+		{Action: cREPAIRREMOVE, Ticket: "CSDFK-1234", Asset: "NEWS2.oet", Path: "CSDFK-1234/NEWS2.oet", Reason: cPROBLEMMISSINGFILESYSTEM},
+		{Action: cREPAIRRENAME, Ticket: "CSDFK-1234", Asset: "Sepsis Screening.oet", From: "Screening.oet",
+			Path: filepath.Join(ticketPath, "Sepsis Screening.oet"), Reason: "same content as Screening.oet, which is gone"},
+	}
+	if !reflect.DeepEqual(plan.Actions, want) {
+		t.Errorf("actions\n%+v\nwant\n%+v", plan.Actions, want)
+	}
+}
+
+func TestPlanTicketRepairNeedsAFingerprintToRename(t *testing.T) {
+
+	writeTestTicket(t, "CSDFK-1234", map[string]string{"Sepsis Screening.oet": "<template>screening</template>"})
+
+	tracked := map[string]damassetRow{"Screening.oet": {Folder: "CSDFK-1234", Filename: "Screening.oet"}}
+
+	// without a deep check's fingerprint a different name is a different file: remove one, register the other
+	plan := repairPlan{Ticket: "CSDFK-1234"}
+	if err := planTicketRepair(context.Background(), &plan, tracked, map[string]assetFingerprint{}); err != nil {
+		t.Fatalf("planTicketRepair: %v", err)
+	}
+	if len(plan.Actions) != 2 || plan.Actions[0].Action != cREPAIRREGISTER || plan.Actions[1].Action != cREPAIRREMOVE {
+		t.Errorf("actions %+v, want a register and a remove", plan.Actions)
+	}
+}
+
+func TestPlanTicketRepairMissingFolder(t *testing.T) {
+
+	writeTestTicket(t, "CSDFK-1234", nil)
+
+	plan := repairPlan{Ticket: "CSDFK-9999"}
+	if err := planTicketRepair(context.Background(), &plan, map[string]damassetRow{}, nil); !os.IsNotExist(err) {
+		t.Errorf("planTicketRepair of a missing folder: %v, want not exist", err)
+	}
+}
+
+func TestPlanRepairRefusesPaths(t *testing.T) {
+
+	for _, ticket := range []string{"", ".", "..", "../CSDFK-1234", `CSDFK-1234\..`, "CSDFK-1234/downloads"} {
+		if _, err := planRepair(context.Background(), ticket); err == nil {
+			t.Errorf("planRepair(%q) planned outside a ticket folder", ticket)
+		}
+	}
+}
+
+func TestRepairToken(t *testing.T) {
+
+	useAckSecret(t, "test secret")
+
+	plan := repairPlan{Ticket: "CSDFK-1234", Actions: []repairAction{
+		{Action: cREPAIRREMOVE, Ticket: "CSDFK-1234", Asset: "NEWS2.oet"},
+	}}
+	token := repairToken(plan)
+
+	if repairToken(plan) != token {
+		t.Error("the same plan gave different tokens")
+	}
+
+	changed := plan
+	changed.Actions = []repairAction{{Action: cREPAIRREMOVE, Ticket: "CSDFK-1234", Asset: "Sepsis.oet"}}
+	if repairToken(changed) == token {
+		t.Error("a plan removing another file has the same token")
+	}
+
+	other := plan
+	other.Ticket = "CSDFK-5678"
+	if repairToken(other) == token {
+		t.Error("the same actions for another ticket have the same token")
+	}
+}
+
+func TestFixTicketRedirectsToTheDryRun(t *testing.T) {
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/FixTicket,CSDFK-1234?token=secret", nil))
+
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if location := w.Header().Get("Location"); location != "/Repair,CSDFK-1234?token=secret" {
+		t.Errorf("redirected to %q", location)
+	}
+}
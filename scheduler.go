@@ -0,0 +1,407 @@
+// Notification and Dashboard Service for DAM
+//
+// built-in job scheduler: runs dispatch, integrity checks etc. on cron-style schedules from config.json
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"         // golang postgres db driver
+	"github.com/robfig/cron/v3" // cron schedule parsing and timing
+)
+
+// outcomes recorded in jobrun.outcome
+const (
+	cJOBRUNNING = "running"
+	cJOBOK      = "ok"
+	cJOBFAILED  = "failed"
+)
+
+var errJobRunning = errors.New("job is already running")
+var errJobUnknown = errors.New("no such job")
+var errJobNotRunning = errors.New("job is not running")
+
+// a unit of periodic work. run returns a one-line summary for the run history.
+type scheduledJob struct {
+	name    string
+	run     func(ctx context.Context) (string, error)
+	spec    string       // cron expression from config, empty when the job only runs on demand
+	entryID cron.EntryID // valid when spec is set
+	running sync.Mutex   // held for the duration of a run, a job never overlaps itself
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // stops the run under way, nil between runs
+}
+
+var jobs = make(map[string]*scheduledJob)
+var scheduler = cron.New()
+
+// makes a job known to the scheduler; call before startScheduler().
+func registerJob(name string, run func(ctx context.Context) (string, error)) {
+	jobs[name] = &scheduledJob{name: name, run: run}
+}
+
+// the jobs built into DAMInform.
+func registerJobs() {
+
+	registerJob("dispatch", func(ctx context.Context) (string, error) {
+		if !doDispatch() {
+			return "", errors.New("one or more notifications could not be sent")
+		}
+		return "", nil
+	})
+
+	registerJob("integritycheck", func(ctx context.Context) (string, error) {
+		result := integrityResult{}
+		ok, err := runIntegrityCheck(ctx, &result)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", errors.New("integrity check could not complete")
+		}
+		return fmt.Sprintf("%d problems found", len(result.Problems)), nil
+	})
+
+	registerJob("integritycheck-deep", func(ctx context.Context) (string, error) {
+		result := integrityResult{Deep: true}
+		ok, err := runIntegrityCheck(ctx, &result)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", errors.New("integrity check could not complete")
+		}
+		return fmt.Sprintf("%d problems found, %d files changed without damasset noticing", len(result.Problems), result.Totals.ContentDrift), nil
+	})
+
+	registerJob("heartbeat", doHeartbeat)
+
+	registerJob("graphcheck", doGraphCheckJob)
+
+	registerJob("digest-daily", func(ctx context.Context) (string, error) {
+		return doDigest(ctx, cDELIVERYDAILY)
+	})
+
+	registerJob("digest-weekly", func(ctx context.Context) (string, error) {
+		return doDigest(ctx, cDELIVERYWEEKLY)
+	})
+
+	registerJob("escalation", doEscalation)
+}
+
+// schedules every registered job that has an entry in config.Jobs and starts the clock.
+func startScheduler() {
+
+	for name, spec := range sessionConfig.Jobs {
+
+		j, ok := jobs[name]
+		if !ok {
+			logMessage("Scheduler: ignoring schedule for unknown job "+name, "", "ERROR")
+			continue
+		}
+		if spec == "" {
+			continue
+		}
+
+		jobname := name
+		id, err := scheduler.AddFunc(spec, func() {
+			if err := runJob(jobname, "schedule"); err != nil && err != errJobRunning {
+				log.Println("DAMInform scheduler: " + jobname + ": " + err.Error())
+			}
+		})
+		if err != nil {
+			logMessage(fmt.Sprintf("Scheduler: bad schedule %q for job %s : %s", spec, name, err.Error()), "", "ERROR")
+			continue
+		}
+
+		j.spec = spec
+		j.entryID = id
+		log.Println("DAMInform scheduler: " + name + " scheduled " + spec)
+	}
+
+	scheduler.Start()
+}
+
+// runs a job now and records the run in jobrun. trigger says who asked ("schedule", "manual", "http").
+// returns errJobRunning if the job is already under way, here or in another DAMInform instance.
+func runJob(name, trigger string) error {
+
+	j, ok := jobs[name]
+	if !ok {
+		return errJobUnknown
+	}
+
+	if !j.running.TryLock() {
+		return errJobRunning
+	}
+	defer j.running.Unlock()
+
+	unlock, err := lockJob(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	started := time.Now()
+	runid := -1
+
+	err = db.QueryRow(`INSERT INTO public.jobrun
+		(job, "trigger", started, outcome)
+		VALUES($1, $2, $3, $4) RETURNING id`, name, trigger, started, cJOBRUNNING).Scan(&runid)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+		}
+		log.Println("DAMInform: unable to record start of job " + name + ": " + err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j.mu.Lock()
+	j.cancel = cancel
+	j.mu.Unlock()
+
+	detail, runErr := j.run(ctx)
+
+	j.mu.Lock()
+	j.cancel = nil
+	j.mu.Unlock()
+	cancel()
+
+	finished := time.Now()
+	outcome := cJOBOK
+	if runErr != nil {
+		outcome = cJOBFAILED
+		detail = runErr.Error()
+		logMessage("Job "+name+" failed : "+detail, "", "ERROR")
+	}
+
+	if runid > -1 {
+		_, err = db.Exec(`UPDATE public.jobrun
+			SET finished = $1, outcome = $2, detail = $3, durationms = $4
+			WHERE id = $5`, finished, outcome, detail, finished.Sub(started).Milliseconds(), runid)
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems recording job run [%d] : %s", runid, err.Code.Name()), "", "ERROR")
+		}
+	}
+
+	return runErr
+}
+
+// stops a job's run under way in this instance; the run records itself as failed.
+func cancelJob(name string) error {
+
+	j, ok := jobs[name]
+	if !ok {
+		return errJobUnknown
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.cancel == nil {
+		return errJobNotRunning
+	}
+	j.cancel()
+
+	return nil
+}
+
+// takes a job's advisory lock, so that DAMInform instances sharing a database never run the same job at once.
+// the lock belongs to a connection of its own, and goes if DAMInform dies mid-run.
+// returns errJobRunning if another instance holds it.
+func lockJob(name string) (func(), error) {
+
+	ctx := context.Background()
+	key := "daminform:" + name
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	locked := false
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`, key).Scan(&locked)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !locked {
+		conn.Close()
+		return nil, errJobRunning
+	}
+
+	return func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock(hashtext($1))`, key); err != nil {
+			log.Println("DAMInform: unable to release the lock for job " + name + ": " + err.Error())
+			// don't hand a connection still holding the lock back to the pool
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}, nil
+}
+
+// lists the jobs with their schedule, most recent run and next run time.
+// formquery goes on the run buttons' action, to carry the admin token the page was opened with.
+func getJobs(report *string, formquery string) bool {
+
+	type lastRun struct {
+		started  pq.NullTime
+		finished pq.NullTime
+		outcome  string
+		detail   string
+		duration int64
+		trigger  string
+	}
+	lastruns := make(map[string]lastRun)
+
+	query := `SELECT DISTINCT ON (job) job, started, finished, outcome, detail, durationms, "trigger"
+		FROM public.jobrun
+		ORDER BY job, started desc`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		name := ""
+		r := lastRun{}
+
+		err = rows.Scan(
+			&name,
+			&r.started,
+			&r.finished,
+			&r.outcome,
+			&r.detail,
+			&r.duration,
+			&r.trigger,
+		)
+
+		if err != nil {
+			log.Println(err.Error())
+			return false
+		}
+
+		lastruns[name] = r
+	}
+
+	names := []string{}
+	for name := range jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tabledef := ""
+	tableheader := ""
+	tablebody := ""
+
+	log.Println("DAMInform.getJobs() ....")
+	tableheader += "<h1>Scheduled jobs</h1><thead><tr>"
+	for _, title := range []string{"Job", "Schedule", "Last started", "Last finished", "Outcome", "Duration (ms)", "Trigger", "Detail", "Next run", ""} {
+		tableheader += fmt.Sprintf("<th>%s</th>", title)
+	}
+	tableheader += "</tr></thead>"
+	tablebody += "<tbody>"
+
+	for _, name := range names {
+		j := jobs[name]
+		r := lastruns[name]
+
+		schedule := j.spec
+		nextrun := ""
+		if schedule == "" {
+			schedule = "on demand"
+		} else {
+			nextrun = scheduler.Entry(j.entryID).Next.Format("2006-01-02 15:04:05")
+		}
+
+		tablebody += "<tr>"
+		tablebody += fmt.Sprintf("<th class='row-header'>%s</th>", name)
+		tablebody += fmt.Sprintf("<td>%s</td>", schedule)
+		tablebody += fmt.Sprintf("<td>%s</td>", formatNullTime(r.started))
+		tablebody += fmt.Sprintf("<td>%s</td>", formatNullTime(r.finished))
+		tablebody += fmt.Sprintf("<td>%s</td>", r.outcome)
+		tablebody += fmt.Sprintf("<td>%d</td>", r.duration)
+		tablebody += fmt.Sprintf("<td>%s</td>", r.trigger)
+		tablebody += fmt.Sprintf("<td>%s</td>", r.detail)
+		tablebody += fmt.Sprintf("<td>%s</td>", nextrun)
+		tablebody += fmt.Sprintf(`<td><form method="post" action="%s"><button type="submit">Run now</button></form></td>`,
+			html.EscapeString(environmentPath("/RunJob,"+name)+formquery))
+		tablebody += "</tr>"
+	}
+
+	tablebody += "</tbody>"
+
+	tabledef = tableheader + tablebody
+
+	overlaptemplate, _ := readlines2("html/reporttemplate.html")
+
+	var line string
+	for i := range overlaptemplate {
+		line = overlaptemplate[i]
+		line = strings.Replace(line, "<cdata>%%TABLE%%</cdata>", tabledef, -1)
+		*report += line
+	}
+
+	return true
+}
+
+// POST /RunJob,<name> (admin) starts a job. a GET link would be followed by mail scanners and crawlers.
+func handleRunJob(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	params := strings.Split(r.URL.Path, ",")
+	if len(params) < 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	jobname := strings.Trim(params[1], "/")
+	if _, ok := jobs[jobname]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// jobs can run for minutes, so reply straight away and let /Jobs show the outcome
+	go func() {
+		if err := runJob(jobname, "manual"); err != nil {
+			log.Println("DAMInform: manual run of " + jobname + ": " + err.Error())
+		}
+	}()
+
+	logMessage("Job "+jobname+" triggered by hand from "+clientAddress(r), "", "INFO")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "%s started", jobname)
+}
+
+func formatNullTime(t pq.NullTime) string {
+	if !t.Valid {
+		return ""
+	}
+	return t.Time.Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleRunJobRefuses(t *testing.T) {
+
+	useConfig(t)
+	sessionConfig.AdminToken = "s3cret"
+
+	for _, c := range []struct {
+		method string
+		target string
+		want   int
+	}{
+		{"GET", "/RunJob,dispatch?token=s3cret", http.StatusMethodNotAllowed}, // a link is not enough
+		{"POST", "/RunJob,dispatch", http.StatusForbidden},
+		{"POST", "/RunJob,dispatch?token=wrong", http.StatusForbidden},
+		{"POST", "/RunJob?token=s3cret", http.StatusBadRequest},
+		{"POST", "/RunJob,nosuchjob?token=s3cret", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(c.method, c.target, nil))
+		if w.Code != c.want {
+			t.Errorf("%s %s: status %d, want %d", c.method, c.target, w.Code, c.want)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Notification and Dashboard Service for DAM
+//
+// schema changes DAMInform needs on top of the tables maintained by DAMLogger
+
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// applied in order on every start, so each statement must be safe to re-run.
+var schemaStatements = []string{
+
+	// per-notification delivery tracking (replaces state.lastnotification)
+	`ALTER TABLE public.notificationqueue ADD COLUMN IF NOT EXISTS status text`,
+	`ALTER TABLE public.notificationqueue ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 0`,
+	`ALTER TABLE public.notificationqueue ADD COLUMN IF NOT EXISTS lasterror text NOT NULL DEFAULT ''`,
+	`ALTER TABLE public.notificationqueue ADD COLUMN IF NOT EXISTS sent timestamp`,
+	`ALTER TABLE public.notificationqueue ADD COLUMN IF NOT EXISTS nextattempt timestamp`,
+	// rows queued before tracking existed: anything at or below the old cursor has already gone out
+	`UPDATE public.notificationqueue
+		SET status = CASE WHEN id <= COALESCE((SELECT max(lastnotification) FROM public.state), -1) THEN 'sent' ELSE 'pending' END
+		WHERE status IS NULL`,
+	`ALTER TABLE public.notificationqueue ALTER COLUMN status SET DEFAULT 'pending'`,
+	`ALTER TABLE public.notificationqueue ALTER COLUMN status SET NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS notificationqueue_status_idx ON public.notificationqueue (status, nextattempt)`,
+
+	// scheduler run history
+	`CREATE TABLE IF NOT EXISTS public.jobrun (
+		id serial PRIMARY KEY,
+		job text NOT NULL,
+		"trigger" text NOT NULL DEFAULT '',
+		started timestamp NOT NULL,
+		finished timestamp,
+		outcome text NOT NULL DEFAULT '',
+		detail text NOT NULL DEFAULT '',
+		durationms bigint NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS jobrun_job_idx ON public.jobrun (job, started desc)`,
+
+	// which channels each notification has gone out on
+	`CREATE TABLE IF NOT EXISTS public.notificationdelivery (
+		notificationid integer NOT NULL,
+		channel text NOT NULL,
+		sent timestamp NOT NULL,
+		PRIMARY KEY (notificationid, channel)
+	)`,
+
+	// digests: who wants what, and what is waiting for them
+	`CREATE TABLE IF NOT EXISTS public.notificationpreference (
+		recipient text PRIMARY KEY,
+		delivery text NOT NULL DEFAULT 'immediate'
+	)`,
+	`CREATE TABLE IF NOT EXISTS public.digestitem (
+		id serial PRIMARY KEY,
+		notificationid integer NOT NULL,
+		recipient text NOT NULL,
+		address text NOT NULL,
+		delivery text NOT NULL,
+		created timestamp NOT NULL,
+		sent timestamp,
+		UNIQUE (notificationid, recipient)
+	)`,
+
+	// which email template a notification uses
+	`ALTER TABLE public.notificationqueue ADD COLUMN IF NOT EXISTS kind text NOT NULL DEFAULT 'general'`,
+
+	// recipient directory: notificationqueue.lead names a user here, or a group
+	`CREATE TABLE IF NOT EXISTS public.recipient (
+		username text PRIMARY KEY,
+		displayname text NOT NULL DEFAULT '',
+		email text NOT NULL,
+		active boolean NOT NULL DEFAULT true
+	)`,
+	`CREATE TABLE IF NOT EXISTS public.recipientgroup (
+		groupname text NOT NULL,
+		username text NOT NULL,
+		PRIMARY KEY (groupname, username)
+	)`,
+
+	// duplicate suppression, one row per kind / ticket / asset / recipient
+	`CREATE TABLE IF NOT EXISTS public.notificationdedup (
+		kind text NOT NULL,
+		jirakey text NOT NULL,
+		asset text NOT NULL,
+		recipient text NOT NULL,
+		notifymgr boolean NOT NULL DEFAULT false,
+		firstseen timestamp NOT NULL,
+		lastsent timestamp,
+		suppressed integer NOT NULL DEFAULT 0,
+		open boolean NOT NULL DEFAULT true,
+		PRIMARY KEY (kind, jirakey, asset, recipient)
+	)`,
+
+	// subscriptions to a jira key, a ticket folder or a template
+	`CREATE TABLE IF NOT EXISTS public.subscription (
+		id serial PRIMARY KEY,
+		username text NOT NULL,
+		kind text NOT NULL,
+		target text NOT NULL,
+		created timestamp NOT NULL,
+		UNIQUE (username, kind, target)
+	)`,
+
+	// severity a notification went out with, from its ticket status
+	`ALTER TABLE public.notificationqueue ADD COLUMN IF NOT EXISTS severity text NOT NULL DEFAULT 'normal'`,
+
+	// acknowledgement, and how far an unacknowledged notification has been escalated
+	`ALTER TABLE public.notificationqueue ADD COLUMN IF NOT EXISTS acknowledged timestamp`,
+	`ALTER TABLE public.notificationqueue ADD COLUMN IF NOT EXISTS acknowledgedby text NOT NULL DEFAULT ''`,
+	`ALTER TABLE public.notificationqueue ADD COLUMN IF NOT EXISTS escalation integer NOT NULL DEFAULT 0`,
+	`ALTER TABLE public.notificationqueue ADD COLUMN IF NOT EXISTS escalates integer`,
+
+	// NOTIFY listeners when notifications are queued, once per insert statement
+	`CREATE OR REPLACE FUNCTION public.daminform_notificationqueue_notify() RETURNS trigger AS $$
+	BEGIN
+		PERFORM pg_notify('daminform_notificationqueue', '');
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS daminform_notify ON public.notificationqueue`,
+	`CREATE TRIGGER daminform_notify AFTER INSERT ON public.notificationqueue
+		FOR EACH STATEMENT EXECUTE PROCEDURE public.daminform_notificationqueue_notify()`,
+
+	// integrity check history: every run, and every problem from the run that found it to the run it was gone
+	`CREATE TABLE IF NOT EXISTS public.integrityrun (
+		id serial PRIMARY KEY,
+		environment text NOT NULL,
+		started timestamp NOT NULL,
+		finished timestamp,
+		durationms bigint,
+		complete boolean NOT NULL DEFAULT false,
+		problems integer NOT NULL DEFAULT 0,
+		newproblems integer NOT NULL DEFAULT 0,
+		resolvedproblems integer NOT NULL DEFAULT 0,
+		folders integer NOT NULL DEFAULT 0,
+		files integer NOT NULL DEFAULT 0,
+		assets integer NOT NULL DEFAULT 0,
+		errors integer NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS integrityrun_environment ON public.integrityrun (environment, started)`,
+	`CREATE TABLE IF NOT EXISTS public.integrityproblem (
+		id serial PRIMARY KEY,
+		environment text NOT NULL,
+		ticket text NOT NULL,
+		asset text NOT NULL,
+		kind text NOT NULL,
+		path text NOT NULL DEFAULT '',
+		firstseen timestamp NOT NULL,
+		lastseen timestamp NOT NULL,
+		firstrun integer NOT NULL,
+		lastrun integer NOT NULL,
+		resolved timestamp,
+		resolvedrun integer
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS integrityproblem_open ON public.integrityproblem (environment, ticket, asset, kind)
+		WHERE resolved is null`,
+
+	// what each tracked asset looked like at the last deep integrity check
+	`CREATE TABLE IF NOT EXISTS public.assetfingerprint (
+		folder text NOT NULL,
+		filename text NOT NULL,
+		size bigint NOT NULL,
+		mtime timestamp NOT NULL,
+		sha256 text NOT NULL,
+		modified boolean NOT NULL,
+		recorded timestamp NOT NULL,
+		PRIMARY KEY (folder, filename)
+	)`,
+
+	// every action the repair planner has applied, and how it went
+	`CREATE TABLE IF NOT EXISTS public.repairaudit (
+		id serial PRIMARY KEY,
+		ticket text NOT NULL,
+		action text NOT NULL,
+		asset text NOT NULL,
+		fromasset text NOT NULL DEFAULT '',
+		path text NOT NULL DEFAULT '',
+		reason text NOT NULL DEFAULT '',
+		outcome text NOT NULL,
+		detail text NOT NULL DEFAULT '',
+		appliedby text NOT NULL DEFAULT '',
+		applied timestamp NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS repairaudit_ticket ON public.repairaudit (upper(ticket), applied)`,
+
+	// each ticket folder's heartbeat canary, and whether DAMLogger recorded it
+	`CREATE TABLE IF NOT EXISTS public.heartbeat (
+		id serial PRIMARY KEY,
+		environment text NOT NULL,
+		started timestamp NOT NULL,
+		folder text NOT NULL,
+		canary text NOT NULL,
+		written timestamp NOT NULL,
+		seen timestamp,
+		latencyms bigint NOT NULL DEFAULT 0,
+		ok boolean NOT NULL,
+		detail text NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS heartbeat_folder ON public.heartbeat (environment, folder, started)`,
+
+	// duplicate suppression is now per address: rows keyed on a lead's username can't be matched any more
+	`UPDATE public.notificationdedup SET open = false WHERE open and recipient NOT LIKE '%@%'`,
+
+	// which channels each digest item has gone out on, so that a digest retried after a partial failure
+	// only repeats the channels that failed
+	`CREATE TABLE IF NOT EXISTS public.digestdelivery (
+		digestitemid integer NOT NULL,
+		channel text NOT NULL,
+		sent timestamp NOT NULL,
+		PRIMARY KEY (digestitemid, channel)
+	)`,
+}
+
+// brings the db up to the schema this build expects.
+func ensureSchema() error {
+
+	for i, statement := range schemaStatements {
+		if _, err := db.Exec(statement); err != nil {
+			log.Println(err.Error())
+			return fmt.Errorf("schema statement %d failed: %s", i, err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+// Notification and Dashboard Service for DAM
+//
+// severity: notifications about tickets in an Emergency or Urgent status go out as high priority
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+)
+
+// values for notificationqueue.severity and config.SeverityByStatus
+const (
+	cSEVERITYNORMAL = "normal"
+	cSEVERITYHIGH   = "high"
+)
+
+// the status -> severity mapping, TitleEmergency and TitleUrgent being high unless config.SeverityByStatus says otherwise.
+func setSeverityDefaults() {
+
+	if sessionConfig.SeverityByStatus == nil {
+		sessionConfig.SeverityByStatus = make(map[string]string)
+	}
+	for _, title := range []string{sessionConfig.TitleEmergency, sessionConfig.TitleUrgent} {
+		if _, ok := sessionConfig.SeverityByStatus[title]; !ok && title != "" {
+			sessionConfig.SeverityByStatus[title] = cSEVERITYHIGH
+		}
+	}
+
+	if sessionConfig.HighPrioritySubjectTag == "" {
+		sessionConfig.HighPrioritySubjectTag = "[HIGH PRIORITY] "
+	}
+}
+
+// severity needs config.TicketStatusQuery, there being no ticket table DAMInform can rely on; without one,
+// or with one that fails, every notification is normal. Either is logged once, here, rather than per notification.
+func initSeverity() {
+
+	if sessionConfig.TicketStatusQuery == "" {
+		logMessage("Severity: no TicketStatusQuery configured, every notification is normal priority", "", "INFO")
+		return
+	}
+
+	status := ""
+	err := db.QueryRow(sessionConfig.TicketStatusQuery, "").Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		logMessage("Severity: TicketStatusQuery fails, every notification is normal priority : "+err.Error(), "", "ERROR")
+		sessionConfig.TicketStatusQuery = ""
+	}
+}
+
+// the status title of a ticket, empty if it can't be found.
+func getTicketStatus(jirakey string) string {
+
+	status := ""
+
+	if jirakey == "" || sessionConfig.TicketStatusQuery == "" {
+		return status
+	}
+
+	err := db.QueryRow(sessionConfig.TicketStatusQuery, jirakey).Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("DAMInform: ticket status of " + jirakey + ": " + err.Error())
+	}
+
+	return status
+}
+
+// how urgent a notification is, going by the status of its ticket.
+func notificationSeverity(n queuedNotification) string {
+
+	status := getTicketStatus(n.JiraKey)
+
+	for title, severity := range sessionConfig.SeverityByStatus {
+		if strings.EqualFold(title, status) && strings.EqualFold(severity, cSEVERITYHIGH) {
+			return cSEVERITYHIGH
+		}
+	}
+
+	return cSEVERITYNORMAL
+}
+
+// high-priority notifications also go out on config.HighPriorityChannels. channels may be config.DefaultChannels
+// itself, shared by every dispatch and preview, so it is added to as a copy.
+func addHighPriorityChannels(channels []string) []string {
+
+	channels = append([]string(nil), channels...)
+
+	seen := make(map[string]bool)
+	for _, c := range channels {
+		seen[c] = true
+	}
+
+	for _, c := range sessionConfig.HighPriorityChannels {
+		if !seen[c] {
+			seen[c] = true
+			channels = append(channels, c)
+		}
+	}
+
+	return channels
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestAddHighPriorityChannels(t *testing.T) {
+
+	useConfig(t)
+	sessionConfig.HighPriorityChannels = []string{"teams", cCHANNELSMTP, "sms"}
+
+	got := addHighPriorityChannels([]string{cCHANNELSMTP, "file"})
+	if want := []string{cCHANNELSMTP, "file", "teams", "sms"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("addHighPriorityChannels() = %v, want %v", got, want)
+	}
+}
+
+func TestAddHighPriorityChannelsLeavesTheDefaultsAlone(t *testing.T) {
+
+	useConfig(t)
+	sessionConfig.HighPriorityChannels = []string{"teams"}
+
+	// as decoded from config.json: room to grow in place
+	defaults := make([]string, 1, 8)
+	defaults[0] = cCHANNELSMTP
+	sessionConfig.DefaultChannels = defaults
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addHighPriorityChannels(routeNotification(queuedNotification{}))
+		}()
+	}
+	wg.Wait()
+
+	if got := sessionConfig.DefaultChannels[:cap(sessionConfig.DefaultChannels)][1]; got != "" {
+		t.Errorf("DefaultChannels' backing array was written: %q", got)
+	}
+}
@@ -0,0 +1,185 @@
+// Notification and Dashboard Service for DAM
+//
+// smtp transport: dialer built from config, and the startup reachability check
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/gomail.v2" // outbound email support
+)
+
+// values for config.SMTPSecurity
+const (
+	cSMTPNONE     = "none"     // plain smtp, as the old "mail":25 relay
+	cSMTPSTARTTLS = "starttls" // upgrade after connecting, refuse servers that can't
+	cSMTPTLS      = "tls"      // implicit tls from the first byte, usually port 465
+)
+
+// a dialer for the configured smtp server.
+func newSMTPDialer() *gomail.Dialer {
+
+	d := gomail.NewDialer(sessionConfig.SMTPHost, sessionConfig.SMTPPort, sessionConfig.SMTPUser, sessionConfig.SMTPPassword)
+	d.SSL = strings.ToLower(sessionConfig.SMTPSecurity) == cSMTPTLS
+	d.TLSConfig = &tls.Config{ServerName: sessionConfig.SMTPHost}
+	d.LocalName, _ = os.Hostname()
+
+	return d
+}
+
+// sends a message through the configured smtp server. with starttls configured the message goes on the
+// same connection that was upgraded, so a server - or anyone in between - that doesn't offer it gets nothing.
+func sendSMTP(m *gomail.Message) error {
+
+	if strings.ToLower(sessionConfig.SMTPSecurity) != cSMTPSTARTTLS {
+		return newSMTPDialer().DialAndSend(m)
+	}
+
+	from, recipients, err := smtpEnvelope(m)
+	if err != nil {
+		return err
+	}
+
+	c, err := dialStartTLS()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err = c.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = m.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// connects, upgrades with STARTTLS - refusing servers that don't offer it - and authenticates when a user is configured.
+func dialStartTLS() (*smtp.Client, error) {
+
+	address := net.JoinHostPort(sessionConfig.SMTPHost, strconv.Itoa(sessionConfig.SMTPPort))
+
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, sessionConfig.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if localName, err := os.Hostname(); err == nil {
+		if err = c.Hello(localName); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		c.Close()
+		return nil, fmt.Errorf("smtp server %s does not offer STARTTLS", address)
+	}
+	if err = c.StartTLS(&tls.Config{ServerName: sessionConfig.SMTPHost}); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if sessionConfig.SMTPUser != "" {
+		auth := smtp.PlainAuth("", sessionConfig.SMTPUser, sessionConfig.SMTPPassword, sessionConfig.SMTPHost)
+		if err = c.Auth(auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// the bare sender and recipient addresses for a message, from its From, To, Cc and Bcc headers.
+func smtpEnvelope(m *gomail.Message) (string, []string, error) {
+
+	from := m.GetHeader("Sender")
+	if len(from) == 0 {
+		from = m.GetHeader("From")
+	}
+	if len(from) == 0 {
+		return "", nil, errors.New("message has no sender")
+	}
+	sender, err := mail.ParseAddress(from[0])
+	if err != nil {
+		return "", nil, err
+	}
+
+	recipients := []string{}
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		for _, a := range m.GetHeader(field) {
+			address, err := mail.ParseAddress(a)
+			if err != nil {
+				return "", nil, err
+			}
+			recipients = append(recipients, address.Address)
+		}
+	}
+	if len(recipients) == 0 {
+		return "", nil, errors.New("message has no recipients")
+	}
+
+	return sender.Address, recipients, nil
+}
+
+// connects (and authenticates, when a user is configured) to the smtp server and logs how that went.
+func checkSMTP() bool {
+
+	address := net.JoinHostPort(sessionConfig.SMTPHost, strconv.Itoa(sessionConfig.SMTPPort))
+
+	var err error
+	if strings.ToLower(sessionConfig.SMTPSecurity) == cSMTPSTARTTLS {
+		var c *smtp.Client
+		if c, err = dialStartTLS(); err == nil {
+			err = c.Quit()
+		}
+	} else {
+		var s gomail.SendCloser
+		if s, err = newSMTPDialer().Dial(); err == nil {
+			err = s.Close()
+		}
+	}
+	if err != nil {
+		logMessage("SMTP: unable to reach "+address+" ("+sessionConfig.SMTPSecurity+") : "+err.Error(), "", "ERROR")
+		fmt.Println("DAMInform v" + gBuild + " - SMTP check failed: " + err.Error())
+		return false
+	}
+
+	logMessage("SMTP: "+address+" ("+sessionConfig.SMTPSecurity+") reachable", "", "INFO")
+	fmt.Println("DAMInform v" + gBuild + " - SMTP " + address + " reachable")
+
+	return true
+}
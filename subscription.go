@@ -0,0 +1,410 @@
+// Notification and Dashboard Service for DAM
+//
+// subscriptions: anyone can follow a jira key, a ticket folder or a template and receive its notifications,
+// including those about assets the template uses
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq" // golang postgres db driver
+)
+
+// what a subscription follows, held in subscription.kind
+const (
+	cSUBSCRIBEJIRAKEY  = "jirakey"  // notifications for one ticket
+	cSUBSCRIBEFOLDER   = "folder"   // notifications for assets in one ticket folder
+	cSUBSCRIBETEMPLATE = "template" // notifications for a template, by resourcemainid, or anything it uses
+)
+
+// how many levels of where-used are followed up from a changed asset to subscribed templates
+const cSUBSCRIBEMAXDEPTH = 10
+
+type subscription struct {
+	ID       int       `json:"id"`
+	Username string    `json:"username"`
+	Kind     string    `json:"kind"`
+	Target   string    `json:"target"`
+	Created  time.Time `json:"created"`
+}
+
+// the usernames subscribed to a notification: to its jira key, to the folder its asset is in,
+// or to its asset or any template that uses the asset.
+func getSubscribers(n queuedNotification) []string {
+
+	query := `WITH RECURSIVE templates(id, depth) AS (
+			SELECT resourcemainid, 0 FROM public.damasset WHERE filename = $2 and $2 <> ''
+			UNION
+			SELECT templateid, 0 FROM public.mirrorstate WHERE filename = $2 and $2 <> ''
+			UNION
+			SELECT rels.parentid, t.depth + 1
+			FROM public.mirrorstate_relationships rels
+			INNER JOIN templates t on rels.childid = t.id
+			WHERE t.depth < $3
+		)
+		SELECT DISTINCT s.username FROM public.subscription s
+		WHERE (s.kind = 'jirakey' and upper(s.target) = upper($1))
+		   or (s.kind = 'folder' and (upper(s.target) = upper($1)
+				or upper(s.target) in (select upper(folder) from public.damasset where filename = $2)))
+		   or (s.kind = 'template' and upper(s.target) in (select upper(id) from templates))
+		ORDER BY 1`
+
+	subscribers := []string{}
+
+	rows, err := db.Query(query, n.JiraKey, n.Asset, cSUBSCRIBEMAXDEPTH)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems finding subscribers to notification [%d] : %s", n.ID, err.Code.Name()), n.JiraKey, "ERROR")
+		}
+		return subscribers
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		username := ""
+		if err = rows.Scan(&username); err == nil {
+			subscribers = append(subscribers, username)
+		}
+	}
+
+	return subscribers
+}
+
+// the recipients a notification reaches through subscriptions; the lead is left out.
+func resolveSubscribers(n queuedNotification) []notificationRecipient {
+
+	recipients := []notificationRecipient{}
+
+	for _, username := range getSubscribers(n) {
+		if strings.EqualFold(username, n.Lead) {
+			continue
+		}
+		recipients = append(recipients, resolveRecipients(username, false)...)
+	}
+
+	return recipients
+}
+
+func addSubscription(s *subscription) error {
+
+	s.Username = strings.TrimSpace(s.Username)
+	s.Kind = strings.ToLower(strings.TrimSpace(s.Kind))
+	s.Target = strings.TrimSpace(s.Target)
+
+	switch s.Kind {
+	case cSUBSCRIBEJIRAKEY, cSUBSCRIBEFOLDER, cSUBSCRIBETEMPLATE:
+	default:
+		return fmt.Errorf("kind must be %s, %s or %s", cSUBSCRIBEJIRAKEY, cSUBSCRIBEFOLDER, cSUBSCRIBETEMPLATE)
+	}
+	if s.Username == "" || s.Target == "" {
+		return fmt.Errorf("username and target are required")
+	}
+
+	s.Created = time.Now()
+
+	err := db.QueryRow(`INSERT INTO public.subscription
+		(username, kind, target, created)
+		VALUES($1, $2, $3, $4)
+		ON CONFLICT (username, kind, target) DO UPDATE SET username = excluded.username
+		RETURNING id, created`, s.Username, s.Kind, s.Target, s.Created).Scan(&s.ID, &s.Created)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems saving subscription of %s to %s %s : %s", s.Username, s.Kind, s.Target, err.Code.Name()), "", "ERROR")
+		}
+		return err
+	}
+
+	logMessage("Subscription: "+s.Username+" subscribed to "+s.Kind+" "+s.Target, "", "INFO")
+
+	return nil
+}
+
+// false if there was no such subscription, or - when username is given - it is someone else's.
+func removeSubscription(id int, username string) bool {
+
+	result, err := db.Exec(`DELETE FROM public.subscription WHERE id = $1 and ($2 = '' or lower(username) = lower($2))`, id, username)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			fmt.Println("pq error:", err.Code.Name())
+			logMessage(fmt.Sprintf("Problems removing subscription [%d] : %s", id, err.Code.Name()), "", "ERROR")
+		}
+		return false
+	}
+
+	removed, _ := result.RowsAffected()
+	if removed > 0 {
+		logMessage(fmt.Sprintf("Subscription: [%d] removed", id), "", "INFO")
+	}
+
+	return removed > 0
+}
+
+// every subscription, or those of one user.
+func getSubscriptions(username string) ([]subscription, bool) {
+
+	query := `SELECT id, username, kind, target, created FROM public.subscription
+		WHERE $1 = '' or lower(username) = lower($1)
+		ORDER BY username, kind, target`
+
+	rows, err := db.Query(query, username)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, false
+	}
+	defer rows.Close()
+
+	subscriptions := []subscription{}
+
+	for rows.Next() {
+		s := subscription{}
+		err = rows.Scan(&s.ID, &s.Username, &s.Kind, &s.Target, &s.Created)
+		if err != nil {
+			log.Println(err.Error())
+			return nil, false
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	return subscriptions, true
+}
+
+func getSubscriptionsJSON(report *string, username string) bool {
+
+	subscriptions, ok := getSubscriptions(username)
+	if !ok {
+		return false
+	}
+
+	content, err := json.MarshalIndent(subscriptions, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+
+	*report += string(content)
+
+	return true
+}
+
+// the subscriptions page: who follows what, with a form to add one and a button to remove each.
+// forms post to formaction; on a signed page they are for username only, and the admin's page links each user's own.
+func getSubscriptionsPage(report *string, username, formaction string, signed, admin bool) bool {
+
+	subscriptions, ok := getSubscriptions(username)
+	if !ok {
+		return false
+	}
+
+	tabledef := ""
+	tableheader := ""
+	tablebody := ""
+
+	log.Println("DAMInform.getSubscriptionsPage() ....")
+
+	userfield := `<input name="username" placeholder="username" required>`
+	if signed {
+		tableheader += fmt.Sprintf("<h1>Subscriptions for %s</h1>", html.EscapeString(username))
+		userfield = fmt.Sprintf(`<input type="hidden" name="username" value="%s">`, html.EscapeString(username))
+	} else {
+		tableheader += "<h1>Subscriptions</h1>"
+	}
+	tableheader += fmt.Sprintf(`<form method="post" action="%s">
+		%s
+		<select name="kind">
+			<option value="jirakey">Jira key</option>
+			<option value="folder">Ticket folder</option>
+			<option value="template">Template (resourcemainid)</option>
+		</select>
+		<input name="target" placeholder="e.g. CSDFK-1234" required>
+		<button type="submit">Subscribe</button>
+		</form>`, html.EscapeString(formaction), userfield)
+	tableheader += "<thead><tr>"
+	tableheader += "<th>User</th><th>Follows</th><th>Target</th><th>Since</th><th></th>"
+	if admin {
+		tableheader += "<th>Their own page</th>"
+	}
+	tableheader += "</tr></thead>"
+	tablebody += "<tbody>"
+
+	for _, s := range subscriptions {
+		tablebody += "<tr>"
+		tablebody += fmt.Sprintf("<th class='row-header'><a href='%s'>%s</a></th>", html.EscapeString(environmentPath("/Subscriptions,"+url.PathEscape(s.Username))), html.EscapeString(s.Username))
+		tablebody += fmt.Sprintf("<td>%s</td>", s.Kind)
+		tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(s.Target))
+		tablebody += fmt.Sprintf("<td>%s</td>", s.Created.Format("2006-01-02"))
+		tablebody += fmt.Sprintf(`<td><form method="post" action="%s"><input type="hidden" name="remove" value="%d"><button type="submit">Unsubscribe</button></form></td>`, html.EscapeString(formaction), s.ID)
+		if admin {
+			tablebody += fmt.Sprintf("<td>%s</td>", html.EscapeString(subscriptionLink(s.Username)))
+		}
+		tablebody += "</tr>"
+	}
+
+	tablebody += "</tbody>"
+
+	tabledef = tableheader + tablebody
+
+	overlaptemplate, _ := readlines2("html/reporttemplate.html")
+
+	var line string
+	for i := range overlaptemplate {
+		line = overlaptemplate[i]
+		line = strings.Replace(line, "<cdata>%%TABLE%%</cdata>", tabledef, -1)
+		*report += line
+	}
+
+	return true
+}
+
+func subscriptionSignature(username string) string {
+
+	mac := hmac.New(sha256.New, ackSecret)
+	mac.Write([]byte("subscriptions:" + strings.ToLower(username)))
+
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// a user's own subscriptions page, for an admin to pass on: with it they can change their subscriptions, nobody else's.
+func subscriptionLink(username string) string {
+	return fmt.Sprintf("%s/Subscriptions,%s,%s", strings.TrimSuffix(sessionConfig.BaseURL, "/"), url.PathEscape(username), subscriptionSignature(username))
+}
+
+// the subscriptions api:
+//
+//	GET    /Subscriptions[,<username>]       the page
+//	GET    /Subscriptions,json[,<username>]  as json
+//	GET    /Subscriptions,<username>,<signature>  a user's own page, from subscriptionLink()
+//	POST   /Subscriptions                    json {"username", "kind", "target"}, or the page's form
+//	DELETE /Subscriptions,<id>
+//
+// POST and DELETE need the admin token, or - POSTed to a user's own page - change only that user's subscriptions.
+func handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(strings.Trim(r.URL.Path, "/"), ",")[1:]
+	for i := range params {
+		params[i] = strings.Trim(params[i], "/")
+	}
+
+	// a user's own page: everything done through it is for them
+	signed := ""
+	if len(params) > 1 && strings.ToLower(params[0]) != "json" {
+		if !hmac.Equal([]byte(params[1]), []byte(subscriptionSignature(params[0]))) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "this subscriptions link is not valid")
+			return
+		}
+		signed = params[0]
+	}
+	admin := isAdmin(r)
+
+	// forms post back to the page they are on, carrying the admin token it was opened with
+	formaction := environmentPath("/Subscriptions")
+	if signed != "" {
+		formaction = environmentPath("/Subscriptions," + url.PathEscape(signed) + "," + params[1])
+	} else if token := r.URL.Query().Get("token"); token != "" {
+		formaction += "?token=" + url.QueryEscape(token)
+	}
+
+	report := ""
+
+	switch r.Method {
+	case "GET":
+		if len(params) > 0 && strings.ToLower(params[0]) == "json" {
+			username := ""
+			if len(params) > 1 {
+				username = params[1]
+			}
+			if getSubscriptionsJSON(&report, username) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, report)
+			}
+			return
+		}
+
+		username := ""
+		if len(params) > 0 {
+			username = params[0]
+		}
+		if getSubscriptionsPage(&report, username, formaction, signed != "", admin && signed == "") {
+			fmt.Fprint(w, report)
+		}
+
+	case "POST":
+		if !admin && signed == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			s := subscription{}
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if signed != "" {
+				s.Username = signed
+			}
+			if err := addSubscription(&s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(s)
+			return
+		}
+
+		// from the page: subscribe, or unsubscribe with "remove", then back to the page
+		if remove := r.FormValue("remove"); remove != "" {
+			id, err := strconv.Atoi(remove)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !removeSubscription(id, signed) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		} else {
+			s := subscription{Username: firstOf(signed, r.FormValue("username")), Kind: r.FormValue("kind"), Target: r.FormValue("target")}
+			if err := addSubscription(&s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		http.Redirect(w, r, formaction, http.StatusSeeOther)
+
+	case "DELETE":
+		if !admin {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if len(params) < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id, err := strconv.Atoi(params[0])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !removeSubscription(id, "") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
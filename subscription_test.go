@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSubscriptionSignature(t *testing.T) {
+
+	useAckSecret(t, "test secret")
+
+	signature := subscriptionSignature("jsmith")
+	if len(signature) != 32 {
+		t.Errorf("signature %q is %d characters, want 32", signature, len(signature))
+	}
+	if subscriptionSignature("JSmith") != signature {
+		t.Error("the signature depends on the username's case")
+	}
+	if subscriptionSignature("jdoe") == signature {
+		t.Error("jsmith and jdoe have the same signature")
+	}
+
+	// a delivery link for the same name must not open the subscriptions page
+	if deliverySignature("jsmith") == signature {
+		t.Error("delivery and subscription signatures are the same")
+	}
+}
+
+func TestSubscriptionLink(t *testing.T) {
+
+	useAckSecret(t, "test secret")
+	useConfig(t)
+	sessionConfig.BaseURL = "http://daminform:9011/env/PROD/"
+
+	want := "http://daminform:9011/env/PROD/Subscriptions,j%20smith," + subscriptionSignature("j smith")
+	if got := subscriptionLink("j smith"); got != want {
+		t.Errorf("subscriptionLink() = %q, want %q", got, want)
+	}
+}
+
+func TestHandleSubscriptionsRefuses(t *testing.T) {
+
+	useAckSecret(t, "test secret")
+	useConfig(t)
+	sessionConfig.AdminToken = "s3cret"
+
+	for _, c := range []struct {
+		method string
+		target string
+		body   string
+		want   int
+	}{
+		// nobody's page without the admin token or their own link
+		{"POST", "/Subscriptions", "username=jsmith&kind=jirakey&target=CSDFK-1234", http.StatusForbidden},
+		{"POST", "/Subscriptions", "remove=7", http.StatusForbidden},
+		{"POST", "/Subscriptions?token=wrong", "remove=7", http.StatusForbidden},
+		{"POST", "/Subscriptions,jsmith", "remove=7", http.StatusForbidden},
+		{"DELETE", "/Subscriptions,7", "", http.StatusForbidden},
+
+		// a link signed for someone else, or not signed at all
+		{"GET", "/Subscriptions,jsmith,0123456789abcdef0123456789abcdef", "", http.StatusForbidden},
+		{"POST", "/Subscriptions,jdoe," + subscriptionSignature("jsmith"), "remove=7", http.StatusForbidden},
+
+		// a user's own link does not delete through the api
+		{"DELETE", "/Subscriptions,jsmith," + subscriptionSignature("jsmith"), "", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handleSubscriptions(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s %s %q: status %d, want %d", c.method, c.target, c.body, w.Code, c.want)
+		}
+	}
+}
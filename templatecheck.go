@@ -0,0 +1,192 @@
+// Notification and Dashboard Service for DAM
+//
+// template content checks: integrity checks read each Template Designer file, to find ones that are not
+// well formed - corrupted or half synced - and ones whose template id and name disagree with damasset and mirrorstate
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// integrityProblem.Kind values
+const (
+	cPROBLEMMALFORMEDTEMPLATE = "malformed template" // not well formed xml, or not a template
+	cPROBLEMTEMPLATEMISMATCH  = "template mismatch"  // id or name disagree with damasset or mirrorstate
+)
+
+// notificationqueue.kind for template content problems: the file itself is wrong, restarting DAMLogger won't help
+const cKINDTEMPLATECONTENT = "templatecontent"
+
+// problems that go out as a templatecontent notification rather than an integrity one
+func isTemplateProblem(kind string) bool {
+	return kind == cPROBLEMMALFORMEDTEMPLATE || kind == cPROBLEMTEMPLATEMISMATCH
+}
+
+// assetType.Format for Template Designer .oet files
+const cFORMATOET = "oet"
+
+// what a template file says about itself: the id and name directly under <template>
+type templateHeader struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// mirrorstate's templates, both ways round
+type templateIndex struct {
+	byFilename map[string]string // filename -> templateid
+	byID       map[string]string // templateid -> filename
+}
+
+func getTemplateIndex() (templateIndex, bool) {
+
+	index := templateIndex{byFilename: make(map[string]string), byID: make(map[string]string)}
+
+	rows, err := db.Query(`SELECT templateid, coalesce(filename, '') FROM public.mirrorstate`)
+	if err != nil {
+		log.Println(err.Error())
+		return index, false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		templateid := ""
+		filename := ""
+		if err = rows.Scan(&templateid, &filename); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		index.byID[templateid] = filename
+		if filename != "" {
+			index.byFilename[filename] = templateid
+		}
+	}
+
+	return index, true
+}
+
+// reads the whole template, so that one cut short is caught, keeping the template's own id and name.
+func readTemplateHeader(r io.Reader) (templateHeader, error) {
+
+	header := templateHeader{}
+
+	decoder := xml.NewDecoder(r)
+	depth := 0
+	element := ""
+	root := ""
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return header, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 {
+				root = t.Name.Local
+			}
+			if depth == 2 {
+				element = t.Name.Local
+			}
+		case xml.EndElement:
+			depth--
+			element = ""
+		case xml.CharData:
+			if depth != 2 {
+				continue
+			}
+			switch element {
+			case "id":
+				header.ID += string(t)
+			case "name":
+				header.Name += string(t)
+			}
+		}
+	}
+
+	if root != "template" {
+		if root == "" {
+			return header, fmt.Errorf("no xml content")
+		}
+		return header, fmt.Errorf("root element is <%s>, not <template>", root)
+	}
+
+	header.ID = strings.TrimSpace(header.ID)
+	header.Name = strings.TrimSpace(header.Name)
+	if header.ID == "" {
+		return header, fmt.Errorf("<template> has no <id>")
+	}
+
+	return header, nil
+}
+
+// checks a template file against its damasset row, when it has one, and against mirrorstate. the file is read once,
+// and hashed as it is parsed; the fingerprint is returned for checkAssetContent(). an error is one reading the file.
+func checkTemplateContent(result *integrityResult, t assetType, ticket, asset, path string, info os.FileInfo, row *damassetRow, index templateIndex) (assetFingerprint, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return assetFingerprint{}, err
+	}
+	defer file.Close()
+
+	result.Content.Templates++
+
+	h := sha256.New()
+	content := io.TeeReader(file, h)
+	header, err := readTemplateHeader(content)
+	// a malformed template stops the parse part way: hash the rest
+	if _, readerr := io.Copy(io.Discard, content); readerr != nil {
+		return assetFingerprint{}, readerr
+	}
+	fingerprint := newFingerprint(info, h)
+
+	if err != nil {
+		result.addProblem(integrityProblem{Ticket: ticket, Asset: asset, Type: t.Name, Kind: cPROBLEMMALFORMEDTEMPLATE, Path: path, DamAsset: row, Detail: err.Error()})
+		logMessage("INTEGRITY: "+result.Environment+" - malformed template "+asset+" : "+err.Error(), ticket, "ERROR")
+		return fingerprint, nil
+	}
+
+	disagreements := []string{}
+
+	if row != nil && row.ResourceMainID != "" && !strings.EqualFold(row.ResourceMainID, header.ID) {
+		disagreements = append(disagreements, fmt.Sprintf("damasset has resourcemainid %s", row.ResourceMainID))
+	}
+	if id, ok := index.byFilename[asset]; ok && !strings.EqualFold(id, header.ID) {
+		disagreements = append(disagreements, fmt.Sprintf("mirrorstate has %s as %s", asset, id))
+	}
+	if filename, ok := index.byID[header.ID]; ok && filename != "" && filename != asset {
+		disagreements = append(disagreements, fmt.Sprintf("mirrorstate has %s as %s", header.ID, filename))
+	}
+	if header.Name != "" && !strings.EqualFold(header.Name, assetDisplayName(asset)) {
+		disagreements = append(disagreements, fmt.Sprintf("the template is named %q", header.Name))
+	}
+
+	if len(disagreements) == 0 {
+		return fingerprint, nil
+	}
+
+	result.addProblem(integrityProblem{
+		Ticket:   ticket,
+		Asset:    asset,
+		Type:     t.Name,
+		Kind:     cPROBLEMTEMPLATEMISMATCH,
+		Path:     path,
+		DamAsset: row,
+		Detail:   fmt.Sprintf("id %s in the file; ", header.ID) + strings.Join(disagreements, "; "),
+	})
+	logMessage("INTEGRITY: "+result.Environment+" - template mismatch "+asset+" : "+strings.Join(disagreements, "; "), ticket, "ERROR")
+
+	return fingerprint, nil
+}
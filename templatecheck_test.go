@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testTemplate = `<?xml version="1.0" encoding="utf-8"?>
+<template xmlns="openEHR/v1/Template">
+  <id>2bd0b5fc-c5c5-4b6a-9b34-6d2a1b8f0c11</id>
+  <name>Sepsis Screening</name>
+  <definition archetype_id="openEHR-EHR-COMPOSITION.encounter.v1">
+    <name>not the template's name</name>
+  </definition>
+</template>
+`
+
+func TestReadTemplateHeader(t *testing.T) {
+
+	header, err := readTemplateHeader(strings.NewReader(testTemplate))
+	if err != nil {
+		t.Fatalf("readTemplateHeader: %v", err)
+	}
+	want := templateHeader{ID: "2bd0b5fc-c5c5-4b6a-9b34-6d2a1b8f0c11", Name: "Sepsis Screening"}
+	if header != want {
+		t.Errorf("readTemplateHeader() = %+v, want %+v", header, want)
+	}
+
+	// as Template Designer sometimes saves them
+	header, err = readTemplateHeader(strings.NewReader("\xef\xbb\xbf" + testTemplate))
+	if err != nil || header != want {
+		t.Errorf("with a byte order mark: %+v, %v", header, err)
+	}
+}
+
+func TestReadTemplateHeaderMalformed(t *testing.T) {
+
+	for _, c := range []struct {
+		name    string
+		content string
+	}{
+		{"empty", ""},
+		{"not xml", "this is not xml"},
+		{"cut short", testTemplate[:len(testTemplate)/2]},
+		{"unclosed", "<template><id>1</id><name>x</name>"},
+		{"mismatched tags", "<template><id>1</name></template>"},
+		{"another root", "<archetype><id>1</id></archetype>"},
+		{"no id", "<template><name>Sepsis Screening</name></template>"},
+		{"empty id", "<template><id>  </id></template>"},
+	} {
+		if header, err := readTemplateHeader(strings.NewReader(c.content)); err == nil {
+			t.Errorf("%s: no error, read %+v", c.name, header)
+		}
+	}
+}
+
+// a template file in a ticket folder, with the fingerprint a deep check should take of it.
+func writeTestTemplate(t *testing.T, name, content string) (string, os.FileInfo) {
+
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "CSDFK-1234", name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, info
+}
+
+func TestCheckTemplateContent(t *testing.T) {
+
+	useUnreachableDB(t)
+
+	useAssetTypes(t)
+
+	const id = "2bd0b5fc-c5c5-4b6a-9b34-6d2a1b8f0c11"
+	template := assetType{Name: "template", Extension: ".oet", Format: cFORMATOET}
+	matching := templateIndex{
+		byFilename: map[string]string{"Sepsis Screening.oet": id},
+		byID:       map[string]string{id: "Sepsis Screening.oet"},
+	}
+
+	for _, c := range []struct {
+		name    string
+		asset   string
+		content string
+		row     *damassetRow
+		index   templateIndex
+		want    string // the kind of problem, none if empty
+		detail  string // in the problem's detail
+	}{
+		{"agrees", "Sepsis Screening.oet", testTemplate, &damassetRow{ResourceMainID: id}, matching, "", ""},
+		{"untracked", "Sepsis Screening.oet", testTemplate, nil, matching, "", ""},
+		{"malformed", "Sepsis Screening.oet", testTemplate[:200], nil, matching, cPROBLEMMALFORMEDTEMPLATE, ""},
+		{"damasset has another id", "Sepsis Screening.oet", testTemplate, &damassetRow{ResourceMainID: "d2f6"}, matching,
+			cPROBLEMTEMPLATEMISMATCH, "damasset has resourcemainid d2f6"},
+		{"mirrorstate has another id", "Sepsis Screening.oet", testTemplate, nil,
+			templateIndex{byFilename: map[string]string{"Sepsis Screening.oet": "d2f6"}, byID: map[string]string{}},
+			cPROBLEMTEMPLATEMISMATCH, "mirrorstate has Sepsis Screening.oet as d2f6"},
+		{"mirrorstate has the id under another file", "Sepsis Screening.oet", testTemplate, nil,
+			templateIndex{byFilename: map[string]string{}, byID: map[string]string{id: "Sepsis.oet"}},
+			cPROBLEMTEMPLATEMISMATCH, "mirrorstate has " + id + " as Sepsis.oet"},
+		{"named differently", "Sepsis.oet", testTemplate, nil, templateIndex{},
+			cPROBLEMTEMPLATEMISMATCH, `the template is named "Sepsis Screening"`},
+	} {
+		path, info := writeTestTemplate(t, c.asset, c.content)
+
+		result := integrityResult{}
+		fingerprint, err := checkTemplateContent(&result, template, "CSDFK-1234", c.asset, path, info, c.row, c.index)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		// hashed while parsed, and all of it even when the parse stops early
+		want, err := fingerprintFile(path, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fingerprint != want {
+			t.Errorf("%s: fingerprint %+v, want %+v", c.name, fingerprint, want)
+		}
+
+		if result.Content.Templates != 1 {
+			t.Errorf("%s: %d templates counted, want 1", c.name, result.Content.Templates)
+		}
+
+		if c.want == "" {
+			if len(result.Problems) > 0 {
+				t.Errorf("%s: problems %+v, want none", c.name, result.Problems)
+			}
+			continue
+		}
+		if len(result.Problems) != 1 || result.Problems[0].Kind != c.want {
+			t.Errorf("%s: problems %+v, want one %s", c.name, result.Problems, c.want)
+			continue
+		}
+		if !strings.Contains(result.Problems[0].Detail, c.detail) {
+			t.Errorf("%s: detail %q does not say %q", c.name, result.Problems[0].Detail, c.detail)
+		}
+	}
+}
+
+func TestCheckTemplateContentUnreadable(t *testing.T) {
+
+	path, info := writeTestTemplate(t, "Sepsis Screening.oet", testTemplate)
+	os.Remove(path)
+
+	result := integrityResult{}
+	if _, err := checkTemplateContent(&result, assetType{Name: "template"}, "CSDFK-1234", "Sepsis Screening.oet", path, info, nil, templateIndex{}); err == nil {
+		t.Error("no error for a file that has gone")
+	}
+	if len(result.Problems) > 0 {
+		t.Errorf("problems %+v for a file that could not be read", result.Problems)
+	}
+}
@@ -0,0 +1,218 @@
+// Notification and Dashboard Service for DAM
+//
+// changeset walker: lists the changeset repository with a bounded pool of workers, so that a slow share is read
+// several folders at a time, stops when its context is cancelled, and reports how far it has got.
+// the integrity check walks the whole repository with it, the repair planner one ticket folder.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often a walk logs its progress
+const cWALKLOGINTERVAL = 30 * time.Second
+
+// a walk under way, as /Walks shows it
+type walkProgress struct {
+	Name    string    `json:"name"`
+	Root    string    `json:"root"`
+	Started time.Time `json:"started"`
+	Folders int64     `json:"folders"` // listed so far
+	Files   int64     `json:"files"`
+	Pending int64     `json:"pending"` // folders waiting for a worker
+}
+
+var walks = struct {
+	sync.Mutex
+	active map[*walkProgress]bool
+}{active: make(map[*walkProgress]bool)}
+
+// one folder's listing, from a worker
+type walkListing struct {
+	dir     string
+	entries []walkEntry
+	err     error
+}
+
+type walkEntry struct {
+	path string
+	info os.FileInfo
+	err  error
+}
+
+// walks root like filepath.Walk - visit sees every folder and file, may return filepath.SkipDir for a folder to
+// skip it or for a file to skip the rest of its folder, and any other error stops the walk - but folders are
+// listed by config.WalkWorkers workers at once.
+// visit is only ever called from the calling goroutine, so it needs no locking; the order is not lexical.
+// returns ctx.Err() when ctx is cancelled before the walk is done.
+func walkChangesets(ctx context.Context, name, root string, visit filepath.WalkFunc) error {
+
+	progress := &walkProgress{Name: name, Root: root, Started: time.Now()}
+	walks.Lock()
+	walks.active[progress] = true
+	walks.Unlock()
+	defer func() {
+		walks.Lock()
+		delete(walks.active, progress)
+		walks.Unlock()
+	}()
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		return visit(root, nil, err)
+	}
+	if err = visit(root, info, nil); err != nil || !info.IsDir() {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := sessionConfig.WalkWorkers
+	todo := make(chan string)
+	listings := make(chan walkListing)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for dir := range todo {
+				listing := listFolder(dir)
+				select {
+				case listings <- listing:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	defer close(todo)
+
+	queue := []string{root}
+	inflight := 0
+	ticker := time.NewTicker(cWALKLOGINTERVAL)
+	defer ticker.Stop()
+
+	for len(queue) > 0 || inflight > 0 {
+
+		// only offer work while there is some, so the select below waits on listings otherwise
+		var next chan string
+		dir := ""
+		if len(queue) > 0 {
+			next = todo
+			dir = queue[len(queue)-1]
+		}
+		atomic.StoreInt64(&progress.Pending, int64(len(queue)))
+
+		select {
+		case next <- dir:
+			queue = queue[:len(queue)-1]
+			inflight++
+
+		case listing := <-listings:
+			inflight--
+			atomic.AddInt64(&progress.Folders, 1)
+
+			if listing.err != nil {
+				if err = visit(listing.dir, nil, listing.err); err != nil && err != filepath.SkipDir {
+					return err
+				}
+			}
+
+		entries:
+			for _, entry := range listing.entries {
+				err = visit(entry.path, entry.info, entry.err)
+				switch {
+				case entry.err == nil && entry.info.IsDir():
+					if err == nil {
+						queue = append(queue, entry.path)
+						continue
+					}
+				case entry.err == nil:
+					atomic.AddInt64(&progress.Files, 1)
+					// as filepath.Walk: SkipDir from a file skips the rest of its folder
+					if err == filepath.SkipDir {
+						break entries
+					}
+				default:
+					atomic.AddInt64(&progress.Files, 1)
+				}
+				if err != nil && err != filepath.SkipDir {
+					return err
+				}
+			}
+
+		case <-ticker.C:
+			log.Printf("DAMInform: walk %s of %s - %d folders, %d files, %d folders to go",
+				name, root, atomic.LoadInt64(&progress.Folders), atomic.LoadInt64(&progress.Files), len(queue)+inflight)
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// reads a folder and stats what is in it; this is the slow part on a network share.
+func listFolder(dir string) walkListing {
+
+	listing := walkListing{dir: dir}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		listing.err = err
+		return listing
+	}
+
+	for _, e := range entries {
+		if isHeartbeatCanary(e.Name()) {
+			continue
+		}
+		entry := walkEntry{path: filepath.Join(dir, e.Name())}
+		entry.info, entry.err = e.Info()
+		listing.entries = append(listing.entries, entry)
+	}
+
+	return listing
+}
+
+// the walks under way, as json, oldest first.
+func getWalks(report *string) bool {
+
+	walks.Lock()
+	active := make([]walkProgress, 0, len(walks.active))
+	for p := range walks.active {
+		active = append(active, walkProgress{
+			Name:    p.Name,
+			Root:    p.Root,
+			Started: p.Started,
+			Folders: atomic.LoadInt64(&p.Folders),
+			Files:   atomic.LoadInt64(&p.Files),
+			Pending: atomic.LoadInt64(&p.Pending),
+		})
+	}
+	walks.Unlock()
+
+	sort.Slice(active, func(i, j int) bool { return active[i].Started.Before(active[j].Started) })
+
+	content, err := json.MarshalIndent(active, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+
+	*report += string(content)
+
+	return true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// a changeset repository of tickets, each with a template and a downloads folder; returns its root.
+func writeTestChangesets(t *testing.T, tickets int) string {
+
+	t.Helper()
+
+	root := t.TempDir()
+	for i := 0; i < tickets; i++ {
+		ticket := filepath.Join(root, fmt.Sprintf("CSDFK-%d", 1000+i))
+		if err := os.MkdirAll(filepath.Join(ticket, "downloads"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range []string{"Sepsis.oet", "downloads/Sepsis.opt"} {
+			if err := os.WriteFile(filepath.Join(ticket, file), []byte("<template/>"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return root
+}
+
+func useWalkWorkers(t *testing.T, workers int) {
+
+	t.Helper()
+
+	useConfig(t)
+	sessionConfig.WalkWorkers = workers
+}
+
+// the paths visit sees, relative to root and sorted, since the walk's own order is not lexical.
+// visit returns filepath.SkipDir for the folder or file called skip.
+func walkedPaths(t *testing.T, walk func(filepath.WalkFunc) error, root string, skip string) ([]string, error) {
+
+	t.Helper()
+
+	paths := []string{}
+	err := walk(func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		paths = append(paths, filepath.ToSlash(rel))
+		if info.Name() == skip {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	sort.Strings(paths)
+
+	return paths, err
+}
+
+func TestWalkChangesetsMatchesFilepathWalk(t *testing.T) {
+
+	root := writeTestChangesets(t, 20)
+	os.WriteFile(filepath.Join(root, "CSDFK-1000", cHEARTBEATPREFIX+"canary"), nil, 0644)
+
+	for _, workers := range []int{1, 4} {
+		useWalkWorkers(t, workers)
+
+		// Sepsis.oet sorts before downloads, so skipping at it skips the rest of the ticket folder
+		for _, skip := range []string{"", "downloads", "Sepsis.oet"} {
+			got, err := walkedPaths(t, func(visit filepath.WalkFunc) error {
+				return walkChangesets(context.Background(), "test", root, visit)
+			}, root, skip)
+			if err != nil {
+				t.Fatalf("walkChangesets: %v", err)
+			}
+
+			want, _ := walkedPaths(t, func(visit filepath.WalkFunc) error {
+				return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+					if err == nil && isHeartbeatCanary(info.Name()) {
+						return nil
+					}
+					return visit(path, info, err)
+				})
+			}, root, skip)
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%d workers, skipping %q: walked %v, want %v", workers, skip, got, want)
+			}
+		}
+	}
+}
+
+func TestWalkChangesetsStopsOnError(t *testing.T) {
+
+	useWalkWorkers(t, 4)
+	root := writeTestChangesets(t, 20)
+
+	stop := errors.New("stop")
+	visited := 0
+	err := walkChangesets(context.Background(), "test", root, func(path string, info os.FileInfo, err error) error {
+		visited++
+		if filepath.Ext(path) == ".oet" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("walkChangesets returned %v, want the visit's error", err)
+	}
+	if visited >= 20*4 {
+		t.Errorf("visited %d paths after the error, want the walk to stop", visited)
+	}
+}
+
+func TestWalkChangesetsCancelled(t *testing.T) {
+
+	useWalkWorkers(t, 4)
+	root := writeTestChangesets(t, 50)
+
+	// cancelled before it starts
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := walkChangesets(ctx, "test", root, func(string, os.FileInfo, error) error { return nil }); err != context.Canceled {
+		t.Errorf("already cancelled: walkChangesets returned %v, want %v", err, context.Canceled)
+	}
+
+	// cancelled part way through, as when the request for a check goes away
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	visited := 0
+	err := walkChangesets(ctx, "test", root, func(path string, info os.FileInfo, err error) error {
+		visited++
+		if visited == 10 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("cancelled: walkChangesets returned %v, want %v", err, context.Canceled)
+	}
+	if visited >= 1+50*5 {
+		t.Errorf("visited all %d paths, want the walk to stop when cancelled", visited)
+	}
+
+	walks.Lock()
+	active := len(walks.active)
+	walks.Unlock()
+	if active != 0 {
+		t.Errorf("%d walks still listed as under way", active)
+	}
+}
+
+func TestWalkChangesetsMissingRoot(t *testing.T) {
+
+	useWalkWorkers(t, 4)
+	root := filepath.Join(t.TempDir(), "missing")
+
+	err := walkChangesets(context.Background(), "test", root, func(path string, info os.FileInfo, err error) error {
+		return err
+	})
+	if !os.IsNotExist(err) {
+		t.Errorf("walkChangesets returned %v, want the root's not exist error", err)
+	}
+}
@@ -0,0 +1,262 @@
+// Notification and Dashboard Service for DAM
+//
+// where used in notifications: the /WhereUsed report for a notification's asset, attached as .xlsx and summarised in the body
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// an asset using the one the report is about
+type whereUsedEntry struct {
+	Name string
+	ID   string
+	CID  string
+}
+
+// the where used report's data: the assets using a template, by section
+type whereUsed struct {
+	AssetID     string
+	AssetName   string
+	OrderPanels []whereUsedEntry
+	SmartGroups []whereUsedEntry
+	OrderSets   []whereUsedEntry
+	Others      []whereUsedEntry
+}
+
+// a file attached to a notification email
+type attachment struct {
+	Name    string
+	Type    string
+	Content []byte
+}
+
+const cXLSXTYPE = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// the resourcemainid of a notification's asset, from damasset for its ticket, else from mirrorstate.
+func getNotificationAssetID(n queuedNotification) string {
+
+	assetID := ""
+
+	if n.Asset == "" {
+		return assetID
+	}
+
+	err := db.QueryRow(`SELECT coalesce(resourcemainid, '') FROM public.damasset
+		WHERE filename = $1 and upper(folder) = upper($2)`, n.Asset, n.JiraKey).Scan(&assetID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err.Error())
+	}
+	if assetID != "" {
+		return assetID
+	}
+
+	// not tracked for the ticket, or tracked without an id yet: the template mirror may know it
+	err = db.QueryRow(`SELECT templateid FROM public.mirrorstate WHERE filename = $1 ORDER BY templateid LIMIT 1`, n.Asset).Scan(&assetID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err.Error())
+	}
+
+	return assetID
+}
+
+// adds the where used summary and spreadsheet to a notification about an asset, when config.AttachWhereUsed is set.
+func addWhereUsed(n queuedNotification, view *notificationView, msg *outboundMessage) {
+
+	if !sessionConfig.AttachWhereUsed {
+		return
+	}
+
+	assetID := getNotificationAssetID(n)
+	if assetID == "" {
+		return
+	}
+
+	wu, ok := getWhereUsed(assetID)
+	if !ok {
+		return
+	}
+
+	view.WhereUsedSummary = wu.summary()
+	view.WhereUsedLink = strings.TrimSuffix(sessionConfig.BaseURL, "/") + "/WhereUsed," + assetID
+
+	content, err := wu.xlsx()
+	if err != nil {
+		logMessage("WhereUsed: problems building the spreadsheet for "+assetID+" : "+err.Error(), n.JiraKey, "ERROR")
+		return
+	}
+
+	name := wu.AssetName
+	if name == "" {
+		name = strings.ReplaceAll(n.Asset, ".oet", "")
+	}
+	msg.Attachments = append(msg.Attachments, attachment{Name: "WUR - " + name + ".xlsx", Type: cXLSXTYPE, Content: content})
+}
+
+// e.g. "used by 3 order panels, 12 order sets"
+func (wu whereUsed) summary() string {
+
+	parts := []string{}
+
+	for _, section := range []struct {
+		count          int
+		single, plural string
+	}{
+		{len(wu.OrderPanels), "order panel", "order panels"},
+		{len(wu.SmartGroups), "smart group", "smart groups"},
+		{len(wu.OrderSets), "order set", "order sets"},
+		{len(wu.Others), "other asset", "other assets"},
+	} {
+		if section.count == 1 {
+			parts = append(parts, "1 "+section.single)
+		} else if section.count > 1 {
+			parts = append(parts, fmt.Sprintf("%d %s", section.count, section.plural))
+		}
+	}
+
+	if len(parts) == 0 {
+		return "not used by any other asset"
+	}
+
+	return "used by " + strings.Join(parts, ", ")
+}
+
+// the where used report as a one-sheet workbook, laid out like the page's Excel export.
+func (wu whereUsed) xlsx() ([]byte, error) {
+
+	rows := [][]string{
+		{wu.AssetName, "", "Where Used Report"},
+		{"Assets containing " + wu.AssetName, "To be Updated?", "Assets where the listed Panel or Smart Group is Embedded", "To be Updated?", "Task Complete?", "Comments"},
+	}
+	bold := map[int]bool{0: true, 1: true}
+
+	for _, section := range []struct {
+		title   string
+		entries []whereUsedEntry
+	}{
+		{"List of all Order Panels", wu.OrderPanels},
+		{"List of all Smart Groups", wu.SmartGroups},
+		{"List of all Order Sets", wu.OrderSets},
+		{"List of all others", wu.Others},
+	} {
+		bold[len(rows)] = true
+		rows = append(rows, []string{section.title})
+
+		if len(section.entries) == 0 {
+			rows = append(rows, []string{"[ none ]"})
+			continue
+		}
+
+		for _, entry := range section.entries {
+			rows = append(rows, []string{"• " + strings.ReplaceAll(entry.Name, ".oet", "")})
+
+			parents := getParents(entry.ID)
+			names := make([]string, 0, len(parents))
+			for name := range parents {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			if len(names) == 0 {
+				rows = append(rows, []string{"", "", "[ none ]"})
+			}
+			for _, name := range names {
+				rows = append(rows, []string{"", "", "• " + strings.ReplaceAll(name, ".oet", "")})
+			}
+		}
+	}
+
+	return writeXLSX("Sheet 1", rows, bold)
+}
+
+// writes the smallest workbook Excel opens cleanly: one sheet of inline strings, with some rows in bold.
+func writeXLSX(sheetname string, rows [][]string, bold map[int]bool) ([]byte, error) {
+
+	var sheet bytes.Buffer
+	sheet.WriteString(xml.Header)
+	sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	sheet.WriteString(`<cols><col min="1" max="1" width="60" customWidth="1"/><col min="2" max="2" width="16" customWidth="1"/>` +
+		`<col min="3" max="3" width="60" customWidth="1"/><col min="4" max="5" width="16" customWidth="1"/><col min="6" max="6" width="40" customWidth="1"/></cols>`)
+	sheet.WriteString(`<sheetData>`)
+
+	for r, row := range rows {
+		fmt.Fprintf(&sheet, `<row r="%d">`, r+1)
+		for c, value := range row {
+			if value == "" {
+				continue
+			}
+			style := ""
+			if bold[r] {
+				style = ` s="1"`
+			}
+			fmt.Fprintf(&sheet, `<c r="%s%d" t="inlineStr"%s><is><t>`, string(rune('A'+c)), r+1, style)
+			xml.EscapeText(&sheet, []byte(value))
+			sheet.WriteString(`</t></is></c>`)
+		}
+		sheet.WriteString(`</row>`)
+	}
+
+	sheet.WriteString(`</sheetData></worksheet>`)
+
+	var workbook bytes.Buffer
+	workbook.WriteString(xml.Header)
+	workbook.WriteString(`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="`)
+	xml.EscapeText(&workbook, []byte(sheetname))
+	workbook.WriteString(`" sheetId="1" r:id="rId1"/></sheets></workbook>`)
+
+	parts := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+			`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+			`</Types>`},
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+			`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", workbook.String()},
+		{"xl/styles.xml", xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+			`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+			`<borders count="1"><border/></borders>` +
+			`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+			`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+			`</styleSheet>`},
+		{"xl/worksheets/sheet1.xml", sheet.String()},
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, part := range parts {
+		w, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}